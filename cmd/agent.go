@@ -44,22 +44,62 @@ func init() {
 }
 
 func serve(c *cli.Context) error {
-	options := []server.OptionFn{
-		server.WithToken(),
+	options := []server.OptionFn{}
+
+	p := c.GlobalString("config")
+	if p == "" {
+		// written by enroll
+		if _, err := os.Stat(server.DefaultConfigPath()); err == nil {
+			p = server.DefaultConfigPath()
+		}
 	}
 
-	if !c.Args().Present() {
-		ec := cli.NewExitError(fmt.Errorf(color.RedString("No target server set.")), 1)
-		return ec
+	if p != "" {
+		fn, err := server.WithConfig(p)
+		if err != nil {
+			ec := cli.NewExitError(color.RedString("Error reading configuration: %s", err.Error()), 1)
+			return ec
+		}
+
+		options = append(options, fn)
 	}
 
-	options = append(options, server.WithServer(c.Args().First()))
+	options = append(options, server.WithEnv(os.Environ()))
 
-	if key := c.GlobalString("remote-key"); key != "" {
-		options = append(options, server.WithKey(key))
-	} else {
-		ec := cli.NewExitError(fmt.Errorf(color.RedString("No remote key set.")), 1)
-		return ec
+	if c.GlobalIsSet("server") {
+		options = append(options, server.WithServer(c.GlobalString("server")))
+	}
+
+	if c.Args().Present() {
+		options = append(options, server.WithServer(c.Args().First()))
+	}
+
+	if c.GlobalIsSet("remote-key") {
+		options = append(options, server.WithKey(c.GlobalString("remote-key")))
+	}
+
+	if c.GlobalIsSet("remote-key-file") {
+		options = append(options, server.WithRemoteKeyFile(c.GlobalString("remote-key-file")))
+	}
+
+	if c.GlobalIsSet("key") {
+		options = append(options, server.WithKeyPair(c.GlobalString("key")))
+	}
+
+	if c.GlobalIsSet("token") {
+		options = append(options, server.WithToken(c.GlobalString("token")))
+	}
+
+	if c.GlobalIsSet("log-level") {
+		options = append(options, server.WithLogLevel(c.GlobalString("log-level")))
+	}
+
+	if c.GlobalIsSet("listen") {
+		options = append(options, server.WithListeners(c.GlobalStringSlice("listen")...))
+	}
+
+	if c.GlobalIsSet("label") {
+		options = append(options, server.WithLabels(c.GlobalStringSlice("label")...))
 	}
 
 	srvr, err := server.New(
@@ -67,7 +107,7 @@ func serve(c *cli.Context) error {
 	)
 
 	if err != nil {
-		ec := cli.NewExitError(err.Error(), 1)
+		ec := cli.NewExitError(color.RedString(err.Error()), 1)
 		return ec
 	}
 
@@ -87,7 +127,10 @@ func serve(c *cli.Context) error {
 	log.Info("Honeytrap Agent starting...")
 	defer log.Info("Honeytrap Agent stopped.")
 
-	srvr.Run(ctx)
+	if err := srvr.Run(ctx); err != nil {
+		return cli.NewExitError(color.RedString(err.Error()), 1)
+	}
+
 	return nil
 }
 
@@ -103,7 +146,7 @@ Commit-ID: %s
 	app := cli.NewApp()
 	app.Name = "honeytrap-agent"
 	app.Usage = "Honeytrap Agent"
-	app.Commands = []cli.Command{}
+	app.Commands = append(keyCommands, enrollCommand)
 
 	app.Before = func(context *cli.Context) error {
 		return nil
@@ -113,9 +156,56 @@ Commit-ID: %s
 
 	app.Flags = append(app.Flags, []cli.Flag{
 		cli.StringFlag{
-			Name:  "remote-key,k",
-			Value: "",
-			Usage: "Remote key of server",
+			Name:   "config,c",
+			Value:  "",
+			Usage:  "Load configuration from `FILE`",
+			EnvVar: "HONEYTRAP_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "server,s",
+			Value:  "",
+			Usage:  "Address of the Honeytrap server",
+			EnvVar: "HONEYTRAP_AGENT_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "remote-key,k",
+			Value:  "",
+			Usage:  "Remote key of server",
+			EnvVar: "HONEYTRAP_AGENT_REMOTE_KEY",
+		},
+		cli.StringFlag{
+			Name:   "remote-key-file",
+			Value:  "",
+			Usage:  "Load the remote key of the server from `FILE`",
+			EnvVar: "HONEYTRAP_AGENT_REMOTE_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "key",
+			Value:  "",
+			Usage:  "Path of the key pair `FILE` of the agent",
+			EnvVar: "HONEYTRAP_AGENT_KEY",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Value:  "",
+			Usage:  "Path of the token file",
+			EnvVar: "HONEYTRAP_AGENT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "",
+			Usage:  "Log level (debug, info, notice, warning, error, critical)",
+			EnvVar: "HONEYTRAP_AGENT_LOG_LEVEL",
+		},
+		cli.StringSliceFlag{
+			Name:   "listen,l",
+			Usage:  "Additional listener, eg. tcp/:8080 or udp/:53",
+			EnvVar: "HONEYTRAP_AGENT_LISTEN",
+		},
+		cli.StringSliceFlag{
+			Name:   "label",
+			Usage:  "Label sent to the server, eg. site=amsterdam",
+			EnvVar: "HONEYTRAP_AGENT_LABELS",
 		},
 	}...)
 
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/honeytrap/honeytrap-agent/server"
+)
+
+// configPath returns the configuration file set with the config flag, or
+// the default configuration file.
+func configPath(c *cli.Context) string {
+	if p := c.GlobalString("config"); p != "" {
+		return p
+	}
+
+	return server.DefaultConfigPath()
+}
+
+func enroll(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return cli.NewExitError(color.RedString("Usage: %s enroll <server> <code>", c.App.Name), 1)
+	}
+
+	keyPath := server.DefaultConfig().Disco.Key
+	if c.GlobalIsSet("key") {
+		keyPath = c.GlobalString("key")
+	}
+
+	e, err := server.Enroll(c.Args().Get(0), c.Args().Get(1), configPath(c), keyPath)
+	if err != nil {
+		return cli.NewExitError(color.RedString(err.Error()), 1)
+	}
+
+	fmt.Println(color.YellowString("Agent enrolled, configuration written to %s.", e.Config))
+	fmt.Println(color.YellowString("Server key: %x", e.RemoteKey))
+	return nil
+}
+
+var enrollCommand = cli.Command{
+	Name:      "enroll",
+	Usage:     "Enroll the agent using a one time enrollment code",
+	ArgsUsage: "<server> <code>",
+	Action:    enroll,
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/honeytrap/honeytrap-agent/server"
+)
+
+// keyPath returns the key pair file from the arguments, the key flag or the
+// default key pair of the agent.
+func keyPath(c *cli.Context) string {
+	if c.Args().Present() {
+		return c.Args().First()
+	}
+
+	if c.GlobalIsSet("key") {
+		return c.GlobalString("key")
+	}
+
+	return server.DefaultConfig().Disco.Key
+}
+
+func keygen(c *cli.Context) error {
+	kp, err := server.GenerateKeyPair(keyPath(c), c.Bool("force"))
+	if err != nil {
+		return cli.NewExitError(color.RedString("Error generating key pair: %s", err.Error()), 1)
+	}
+
+	fmt.Println(kp.ExportPublicKey())
+	return nil
+}
+
+func pubkey(c *cli.Context) error {
+	kp, err := server.LoadKeyPair(keyPath(c))
+	if err != nil {
+		return cli.NewExitError(color.RedString("Error loading key pair: %s", err.Error()), 1)
+	}
+
+	fmt.Println(kp.ExportPublicKey())
+	return nil
+}
+
+var keyCommands = []cli.Command{
+	{
+		Name:      "keygen",
+		Usage:     "Generate the static key pair of the agent",
+		ArgsUsage: "[FILE]",
+		Action:    keygen,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "force,f",
+				Usage: "Overwrite an existing key pair",
+			},
+		},
+	},
+	{
+		Name:      "pubkey",
+		Usage:     "Print the public key of the agent",
+		ArgsUsage: "[FILE]",
+		Action:    pubkey,
+	},
+}
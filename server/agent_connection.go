@@ -33,85 +33,217 @@ package server
 import (
 	"encoding"
 	"encoding/binary"
-	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync"
+	"time"
 )
 
 type agentConnection struct {
 	net.Conn
+
+	// largeFrames is set when 32 bit frame lengths have been negotiated.
+	largeFrames bool
+
+	// maxFrameSize is the largest frame accepted from the server,
+	// peerMaxFrameSize the largest frame the server accepts.
+	maxFrameSize     int
+	peerMaxFrameSize int
+
+	// wm serializes writing frames, writeTimeout limits the time a
+	// frame may take to be written, zero disables the limit.
+	wm           sync.Mutex
+	writeTimeout time.Duration
 }
 
-func (ac agentConnection) receive() (interface{}, error) {
-	buff := make([]byte, 1)
+func newAgentConnection(conn net.Conn) *agentConnection {
+	return &agentConnection{
+		Conn:             conn,
+		maxFrameSize:     LegacyMaxFrameSize,
+		peerMaxFrameSize: LegacyMaxFrameSize,
+	}
+}
 
-	n, err := ac.Conn.Read(buff)
-	if n == 0 {
-		return nil, errors.New("Could not read object")
-	} else if err != nil {
-		return nil, err
+// negotiate applies the frame settings agreed on in the handshake.
+func (ac *agentConnection) negotiate(caps Capabilities, maxFrameSize int, peerMaxFrameSize int) {
+	if !caps.Has(CapabilityLargeFrames) {
+		return
+	}
+
+	// every server supporting large frames accepts legacy sized frames
+	if peerMaxFrameSize < LegacyMaxFrameSize {
+		peerMaxFrameSize = LegacyMaxFrameSize
 	}
 
-	type_ := int(buff[0])
+	ac.largeFrames = true
+	ac.maxFrameSize = maxFrameSize
+	ac.peerMaxFrameSize = peerMaxFrameSize
+}
+
+// UnknownTypeError is returned for frames with an unknown message type.
+type UnknownTypeError struct {
+	Type int
+}
+
+func (e UnknownTypeError) Error() string {
+	return fmt.Sprintf("Unknown message type 0x%02x", e.Type)
+}
 
-	var o encoding.BinaryUnmarshaler
+// FrameSizeError is returned for frames exceeding the maximum frame size.
+type FrameSizeError struct {
+	Size int
+	Max  int
+}
+
+func (e FrameSizeError) Error() string {
+	return fmt.Sprintf("Frame of %d bytes exceeds maximum frame size of %d bytes", e.Size, e.Max)
+}
 
+// DecodeError is returned for frames of which the message can't be
+// decoded.
+type DecodeError struct {
+	Type int
+	Err  error
+}
+
+func (e DecodeError) Error() string {
+	return fmt.Sprintf("Error decoding message type 0x%02x: %s", e.Type, e.Err.Error())
+}
+
+// newMessage returns an empty message for the message type.
+func newMessage(type_ int) (encoding.BinaryUnmarshaler, error) {
 	switch type_ {
 	case TypeHello:
-		o = &Hello{}
+		return &Hello{}, nil
 	case TypePing:
-		o = &Ping{}
+		return &Ping{}, nil
 	case TypeHandshake:
-		o = &Handshake{}
+		return &Handshake{}, nil
 	case TypeHandshakeResponse:
-		o = &HandshakeResponse{}
+		return &HandshakeResponse{}, nil
 	case TypeReadWrite:
-		o = &ReadWrite{}
+		return &ReadWrite{}, nil
 	case TypeEOF:
-		o = &EOF{}
+		return &EOF{}, nil
+	case TypeWindow:
+		return &Window{}, nil
+	case TypeListenerUpdate:
+		return &ListenerUpdate{}, nil
+	case TypeListenerAck:
+		return &ListenerAck{}, nil
+	case TypePong:
+		return &Pong{}, nil
+	case TypeAck:
+		return &Ack{}, nil
+	case TypeResume:
+		return &Resume{}, nil
+	case TypeEnrollRequest:
+		return &EnrollRequest{}, nil
+	case TypeEnrollResponse:
+		return &EnrollResponse{}, nil
+	case TypeError:
+		return &Error{}, nil
+	case TypeControl:
+		return &Control{}, nil
+	case TypeReport:
+		return &Report{}, nil
+	default:
+		return nil, UnknownTypeError{Type: type_}
 	}
+}
 
-	buff = make([]byte, 2)
+// readFrame reads a single frame from r, consisting of the message type,
+// the length of the message and the message. Frames with an unknown type,
+// exceeding maxFrameSize or containing an invalid message are rejected.
+// Frames with an unknown type are read completely, so the next frame can
+// still be read.
+func readFrame(r io.Reader, largeFrames bool, maxFrameSize int) (interface{}, error) {
+	header := make([]byte, 3)
+	if largeFrames {
+		header = make([]byte, 5)
+	}
 
-	n, err = ac.Conn.Read(buff)
-	if n == 0 {
-		return nil, errors.New("Could not read object")
-	} else if err != nil {
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
 
-	size := binary.LittleEndian.Uint16(buff)
+	type_ := int(header[0])
+
+	var size int
+	if largeFrames {
+		size = int(binary.LittleEndian.Uint32(header[1:]))
+	} else {
+		size = int(binary.LittleEndian.Uint16(header[1:]))
+	}
 
-	buff = make([]byte, size)
+	if size > maxFrameSize {
+		return nil, FrameSizeError{Size: size, Max: maxFrameSize}
+	}
 
-	n, err = ac.Conn.Read(buff)
-	if err != nil {
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(r, buff); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
 		return nil, err
-	} else if n == 0 {
-		return nil, errors.New("Could not read object")
 	}
 
-	if err := o.UnmarshalBinary(buff[:n]); err != nil {
+	o, err := newMessage(type_)
+	if err != nil {
 		return nil, err
 	}
 
+	if err := o.UnmarshalBinary(buff); err != nil {
+		return nil, DecodeError{Type: type_, Err: err}
+	}
+
 	return o, nil
 }
 
-func (ac agentConnection) send(o encoding.BinaryMarshaler) error {
-	// write type
+func (ac *agentConnection) receive() (interface{}, error) {
+	return readFrame(ac.Conn, ac.largeFrames, ac.maxFrameSize)
+}
+
+func (ac *agentConnection) send(o encoding.BinaryMarshaler) error {
+	var type_ int
+
 	switch o.(type) {
 	case Hello:
-		ac.Conn.Write([]byte{uint8(TypeHello)})
+		type_ = TypeHello
 	case Handshake:
-		ac.Conn.Write([]byte{uint8(TypeHandshake)})
+		type_ = TypeHandshake
 	case HandshakeResponse:
-		ac.Conn.Write([]byte{uint8(TypeHandshakeResponse)})
+		type_ = TypeHandshakeResponse
 	case ReadWrite:
-		ac.Conn.Write([]byte{uint8(TypeReadWrite)})
+		type_ = TypeReadWrite
 	case Ping:
-		ac.Conn.Write([]byte{uint8(TypePing)})
+		type_ = TypePing
 	case EOF:
-		ac.Conn.Write([]byte{uint8(TypeEOF)})
+		type_ = TypeEOF
+	case Window:
+		type_ = TypeWindow
+	case ListenerUpdate:
+		type_ = TypeListenerUpdate
+	case ListenerAck:
+		type_ = TypeListenerAck
+	case Pong:
+		type_ = TypePong
+	case Ack:
+		type_ = TypeAck
+	case Resume:
+		type_ = TypeResume
+	case EnrollRequest:
+		type_ = TypeEnrollRequest
+	case EnrollResponse:
+		type_ = TypeEnrollResponse
+	case Error:
+		type_ = TypeError
+	case Control:
+		type_ = TypeControl
+	case Report:
+		type_ = TypeReport
+	default:
+		return fmt.Errorf("Unsupported message type %T", o)
 	}
 
 	data, err := o.MarshalBinary()
@@ -119,14 +251,31 @@ func (ac agentConnection) send(o encoding.BinaryMarshaler) error {
 		return err
 	}
 
-	buff := make([]byte, 2)
-	binary.LittleEndian.PutUint16(buff[0:2], uint16(len(data)))
+	if len(data) > ac.peerMaxFrameSize {
+		return FrameSizeError{Size: len(data), Max: ac.peerMaxFrameSize}
+	}
+
+	// write the type, length and data at once, to prevent partial frames
+	buff := []byte{uint8(type_)}
 
-	if _, err := ac.Conn.Write(buff); err != nil {
-		return err
+	if ac.largeFrames {
+		buff = append(buff, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buff[1:5], uint32(len(data)))
+	} else {
+		buff = append(buff, 0, 0)
+		binary.LittleEndian.PutUint16(buff[1:3], uint16(len(data)))
 	}
 
-	if _, err := ac.Conn.Write(data); err != nil {
+	buff = append(buff, data...)
+
+	ac.wm.Lock()
+	defer ac.wm.Unlock()
+
+	if ac.writeTimeout > 0 {
+		ac.Conn.SetWriteDeadline(time.Now().Add(ac.writeTimeout))
+	}
+
+	if _, err := ac.Conn.Write(buff); err != nil {
 		return err
 	}
 
@@ -0,0 +1,486 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	logging "github.com/op/go-logging"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Overflow policies, applied when the queue of a session is full.
+const (
+	// OverflowDrop drops the data that doesn't fit the queue.
+	OverflowDrop = "drop"
+	// OverflowPause keeps the data and stops returning credit to the
+	// server, until the queue has room again. Sessions of servers
+	// without flow control are reset.
+	OverflowPause = "pause"
+	// OverflowClose resets the session.
+	OverflowClose = "close"
+)
+
+// Distribution modes, selecting the server new sessions are forwarded to.
+const (
+	// DistributionFailover forwards the sessions to the first server
+	// that is connected, in the configured order.
+	DistributionFailover = "failover"
+	// DistributionSourceIP spreads the sessions across the connected
+	// servers, sessions from the same source ip are forwarded to the same
+	// server.
+	DistributionSourceIP = "source-ip"
+)
+
+// ServerConfig contains the address and public key of a Honeytrap server.
+type ServerConfig struct {
+	Host      string `yaml:"host"`
+	RemoteKey string `yaml:"remote-key"`
+
+	// RemoteKeyFile is the path of the file containing the remote key,
+	// used instead of RemoteKey.
+	RemoteKeyFile string `yaml:"remote-key-file"`
+}
+
+// Config contains the configuration of the agent, as read from the yaml
+// configuration file. The settings can be overridden using environment
+// variables, see LoadEnv, and the most common ones using command line
+// flags.
+type Config struct {
+	// Host is the address of the Honeytrap server.
+	Host string `yaml:"host"`
+
+	// RemoteKey is the hex encoded public key of the Honeytrap server.
+	RemoteKey string `yaml:"remote-key"`
+
+	// RemoteKeyFile is the path of the file containing the public key of
+	// the Honeytrap server, either hex encoded or as key pair.
+	RemoteKeyFile string `yaml:"remote-key-file"`
+
+	// Servers contains the servers used besides Host, in order of
+	// preference.
+	Servers []ServerConfig `yaml:"servers"`
+
+	Distribution string `yaml:"distribution"`
+
+	// Token is the path of the file containing the agent token, relative
+	// paths are resolved against the Honeytrap home directory.
+	Token string `yaml:"token"`
+
+	LogLevel string `yaml:"log-level"`
+
+	// Ports contains listeners that will be started in addition to the
+	// addresses received from the server, eg. tcp/:8080 or udp/:53.
+	Ports []string `yaml:"ports"`
+
+	// Labels are sent to the server with the handshake, to group the
+	// agents by eg. site, region or customer.
+	Labels map[string]string `yaml:"labels"`
+
+	// QueueSize is the number of frames queued for each session before
+	// the overflow policy is applied.
+	QueueSize int    `yaml:"queue-size"`
+	Overflow  string `yaml:"overflow"`
+
+	// MaxFrameSize is the largest frame accepted from the server, when
+	// the server supports large frames.
+	MaxFrameSize int `yaml:"max-frame-size"`
+
+	// HeartbeatInterval is the interval pings are sent to the server.
+	HeartbeatInterval time.Duration `yaml:"heartbeat-interval"`
+
+	// MaxMissedPongs is the number of consecutive unanswered pings after
+	// which the server is considered dead and the agent reconnects.
+	MaxMissedPongs int `yaml:"max-missed-pongs"`
+
+	// ResumeBuffer is the number of bytes kept per session until the
+	// server acknowledged them, allowing the session to be resumed after
+	// reconnecting. Zero disables resumption.
+	ResumeBuffer int `yaml:"resume-buffer"`
+
+	// ResumeTimeout is the time sessions are kept open while the
+	// connection with the server is lost.
+	ResumeTimeout time.Duration `yaml:"resume-timeout"`
+
+	// ReconnectDelay is the delay before reconnecting after the first
+	// failed attempt, it doubles after every attempt up to
+	// MaxReconnectDelay.
+	ReconnectDelay    time.Duration `yaml:"reconnect-delay"`
+	MaxReconnectDelay time.Duration `yaml:"max-reconnect-delay"`
+
+	// HandshakeTimeout is the time given to connect to a server, including
+	// the handshakes of the transport and the protocol.
+	HandshakeTimeout time.Duration `yaml:"handshake-timeout"`
+
+	// DrainTimeout is the time given to close the sessions and to flush
+	// the messages to the servers when shutting down, after which the
+	// connections are closed.
+	DrainTimeout time.Duration `yaml:"drain-timeout"`
+
+	// Limits restricts the duration and the traffic of the sessions.
+	Limits LimitsConfig `yaml:"limits"`
+
+	// Filter decides which sources are forwarded.
+	Filter FilterConfig `yaml:"filter"`
+
+	// RateLimits restricts the sessions per source, per listener and in
+	// total.
+	RateLimits RateLimitConfig `yaml:"rate-limits"`
+
+	// ReportInterval is the interval the connections that haven't been
+	// forwarded are reported to the server.
+	ReportInterval time.Duration `yaml:"report-interval"`
+
+	// Transport is used to connect to the servers: disco, tls or tcp.
+	Transport string `yaml:"transport"`
+
+	TLS TLSConfig `yaml:"tls"`
+
+	Disco DiscoConfig `yaml:"disco"`
+}
+
+// DefaultConfig returns the configuration used when no configuration file
+// has been supplied.
+func DefaultConfig() Config {
+	return Config{
+		Token:        "token",
+		Distribution: DistributionFailover,
+		Disco: DiscoConfig{
+			Pattern: PatternNK,
+			Key:     "agent.key",
+		},
+		LogLevel:          "info",
+		QueueSize:         64,
+		Overflow:          OverflowClose,
+		MaxFrameSize:      1024 * 1024,
+		HeartbeatInterval: 5 * time.Second,
+		MaxMissedPongs:    3,
+		ResumeBuffer:      256 * 1024,
+		ResumeTimeout:     30 * time.Second,
+		ReconnectDelay:    time.Second,
+		MaxReconnectDelay: time.Minute,
+		HandshakeTimeout:  30 * time.Second,
+		DrainTimeout:      10 * time.Second,
+		Limits: LimitsConfig{
+			Limits: Limits{
+				IdleTimeout: 5 * time.Minute,
+			},
+		},
+		Filter: FilterConfig{
+			Action:         ActionDrop,
+			ReloadInterval: 10 * time.Second,
+		},
+		RateLimits: RateLimitConfig{
+			Action:     ActionReject,
+			MaxDelay:   5 * time.Second,
+			MaxDelayed: 1024,
+			MaxLocal:   1024,
+			IPv4Prefix: 32,
+			IPv6Prefix: 128,
+		},
+		ReportInterval: time.Minute,
+	}
+}
+
+// Load reads the yaml configuration from r, overriding the settings that
+// are set in the file.
+func (c *Config) Load(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("Error parsing configuration: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Validate checks the configuration for missing or invalid settings.
+func (c *Config) Validate() error {
+	servers := c.servers()
+	if len(servers) == 0 {
+		return errors.New("No target server set.")
+	}
+
+	switch c.Transport {
+	case "", TransportDisco, TransportTLS, TransportTCP:
+	default:
+		return fmt.Errorf("Invalid transport %q, expected disco, tls or tcp.", c.Transport)
+	}
+
+	if c.TLS.Enabled && c.transport() != TransportTLS {
+		return fmt.Errorf("Tls is enabled, but transport %s has been selected.", c.Transport)
+	}
+
+	if c.transport() == TransportDisco {
+		if err := c.Disco.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range servers {
+		if err := s.Validate(c.transport() == TransportDisco && c.Disco.requireRemoteKey()); err != nil {
+			return err
+		}
+	}
+
+	if c.transport() == TransportTLS {
+		if err := c.TLS.Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch c.Distribution {
+	case DistributionFailover, DistributionSourceIP:
+	default:
+		return fmt.Errorf("Invalid distribution %q, expected failover or source-ip.", c.Distribution)
+	}
+
+	if c.Token == "" {
+		return errors.New("No token path set.")
+	}
+
+	if _, err := logging.LogLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("Invalid log level %q.", c.LogLevel)
+	}
+
+	for _, port := range c.Ports {
+		if _, err := parseListenAddr(port); err != nil {
+			return fmt.Errorf("Invalid listener %q: %s", port, err.Error())
+		}
+	}
+
+	for k, v := range c.Labels {
+		if k == "" {
+			return errors.New("Invalid label, the name is empty.")
+		}
+
+		if len(k) > 0xFFFF || len(v) > 0xFFFF {
+			return fmt.Errorf("Invalid label %q, too large.", k)
+		}
+	}
+
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("Invalid queue size %d.", c.QueueSize)
+	}
+
+	switch c.Overflow {
+	case OverflowDrop, OverflowPause, OverflowClose:
+	default:
+		return fmt.Errorf("Invalid overflow policy %q, expected drop, pause or close.", c.Overflow)
+	}
+
+	if c.MaxFrameSize < LegacyMaxFrameSize {
+		return fmt.Errorf("Invalid maximum frame size %d, should be at least %d bytes.", c.MaxFrameSize, LegacyMaxFrameSize)
+	}
+
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("Invalid heartbeat interval %s.", c.HeartbeatInterval)
+	}
+
+	if c.MaxMissedPongs <= 0 {
+		return fmt.Errorf("Invalid number of missed pongs %d.", c.MaxMissedPongs)
+	}
+
+	if c.ResumeBuffer < 0 {
+		return fmt.Errorf("Invalid resume buffer size %d.", c.ResumeBuffer)
+	}
+
+	if c.ResumeBuffer > 0 && c.ResumeTimeout <= 0 {
+		return fmt.Errorf("Invalid resume timeout %s.", c.ResumeTimeout)
+	}
+
+	if c.ReconnectDelay <= 0 {
+		return fmt.Errorf("Invalid reconnect delay %s.", c.ReconnectDelay)
+	}
+
+	if c.MaxReconnectDelay < c.ReconnectDelay {
+		return fmt.Errorf("Invalid max reconnect delay %s, less than the reconnect delay.", c.MaxReconnectDelay)
+	}
+
+	if c.HandshakeTimeout <= 0 {
+		return fmt.Errorf("Invalid handshake timeout %s.", c.HandshakeTimeout)
+	}
+
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("Invalid drain timeout %s.", c.DrainTimeout)
+	}
+
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Filter.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.RateLimits.Validate(); err != nil {
+		return err
+	}
+
+	if c.ReportInterval <= 0 {
+		return fmt.Errorf("Invalid report interval %s.", c.ReportInterval)
+	}
+
+	return nil
+}
+
+// servers returns the configured servers in order of preference.
+func (c *Config) servers() []ServerConfig {
+	servers := []ServerConfig{}
+
+	if c.Host != "" || c.RemoteKey != "" || c.RemoteKeyFile != "" {
+		servers = append(servers, ServerConfig{
+			Host:          c.Host,
+			RemoteKey:     c.RemoteKey,
+			RemoteKeyFile: c.RemoteKeyFile,
+		})
+	}
+
+	return append(servers, c.Servers...)
+}
+
+// transport returns the selected transport, tls.enabled selects tls for
+// compatibility.
+func (c *Config) transport() string {
+	if c.Transport != "" {
+		return c.Transport
+	}
+
+	if c.TLS.Enabled {
+		return TransportTLS
+	}
+
+	return TransportDisco
+}
+
+// Validate checks the server settings, the remote key is only required
+// when requireKey is set.
+func (s *ServerConfig) Validate(requireKey bool) error {
+	if s.Host == "" {
+		return errors.New("No target server set.")
+	}
+
+	if _, _, err := net.SplitHostPort(serverAddress(s.Host)); err != nil {
+		return fmt.Errorf("Invalid server address %q: %s", s.Host, err.Error())
+	}
+
+	if s.RemoteKey != "" && s.RemoteKeyFile != "" {
+		return fmt.Errorf("Both remote key and remote key file set for %s.", s.Host)
+	}
+
+	if s.RemoteKey == "" && s.RemoteKeyFile == "" && !requireKey {
+		return nil
+	} else if s.RemoteKey == "" && s.RemoteKeyFile == "" {
+		return fmt.Errorf("No remote key set for %s.", s.Host)
+	}
+
+	if _, err := s.key(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// key returns the remote key of the server, or nil if none has been set.
+func (s *ServerConfig) key() ([]byte, error) {
+	if s.RemoteKeyFile != "" {
+		key, err := loadPublicKey(s.RemoteKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading remote key for %s: %s", s.Host, err.Error())
+		}
+
+		return key, nil
+	}
+
+	if s.RemoteKey == "" {
+		return nil, nil
+	}
+
+	key, err := decodeKey(s.RemoteKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid remote key for %s: %s", s.Host, err.Error())
+	}
+
+	return key, nil
+}
+
+func (c *TLSConfig) Validate() error {
+	if (c.Certificate == "") != (c.Key == "") {
+		return errors.New("Both the tls certificate and key should be set.")
+	}
+
+	for _, pin := range c.Pins {
+		if data, err := hex.DecodeString(pin); err != nil || len(data) != sha256.Size {
+			return fmt.Errorf("Invalid pin %q, expected a hex encoded sha256 hash.", pin)
+		}
+	}
+
+	return nil
+}
+
+// serverAddress returns the address of the server, using the default port
+// if none has been set.
+func serverAddress(s string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+
+	return net.JoinHostPort(strings.Trim(s, "[]"), "1337")
+}
+
+// parseListenAddr parses listener addresses in the form network/address,
+// where network is either tcp or udp. The network defaults to tcp.
+func parseListenAddr(s string) (net.Addr, error) {
+	network, address := "tcp", s
+	if parts := strings.SplitN(s, "/", 2); len(parts) == 2 {
+		network, address = parts[0], parts[1]
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return net.ResolveTCPAddr(network, address)
+	case "udp", "udp4", "udp6":
+		return net.ResolveUDPAddr(network, address)
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", network)
+	}
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"encoding"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -11,65 +16,600 @@ const (
 )
 
 type conn struct {
+	// lastActivity contains the unix time in nanoseconds of the last
+	// traffic, it is accessed atomically and kept first for alignment.
+	lastActivity int64
+
 	net.Conn
 
 	out  chan []byte
 	host string
 
+	// backlog contains the data received while out was full, using the
+	// pause policy. Flow control bounds it to the window of the session.
+	// It is guarded by m, the writer is signalled through more.
+	backlog [][]byte
+	more    chan struct{}
+
 	agent *Agent
+
+	// remote is the server the session is forwarded to.
+	remote *remote
+
+	// id is the stream id allocated for this session.
+	id uint32
+
+	m           sync.Mutex
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+
+	// halfClose is closed when Honeytrap closed its side of the
+	// connection, the writer closes the write side after writing the
+	// queued data. halfClosed is set once closed, guarded by m.
+	halfClose  chan struct{}
+	halfClosed bool
+
+	// reason contains the close reason, once closed.
+	reason int
+
+	// upstream is the id of the server connection the session has been
+	// announced on, zero if it hasn't been announced yet. Data will only
+	// be forwarded on that connection.
+	upstream uint32
+
+	// sent contains the data sent to the server that hasn't been
+	// acknowledged, it will be replayed when the session is resumed.
+	sent sendBuffer
+
+	// received contains the number of bytes received from the server.
+	received uint64
+
+	// done will be closed when the connection has been closed.
+	done chan struct{}
+
+	// credit contains the number of bytes the server allows us to send,
+	// guarded by m and signalled through cond.
+	credit int64
+	cond   *sync.Cond
+
+	// consumed contains the number of bytes written to the attacker that
+	// haven't been returned to the server as credit yet.
+	consumed int
+
+	limits Limits
+
+	// ticket holds the rate limits of the session, released on close.
+	ticket *ticket
+
+	// bytesIn and bytesOut count the bytes read from and written to the
+	// attacker, used by the reader and writer respectively.
+	bytesIn  int64
+	bytesOut int64
+
+	// idle and expiry enforce the idle timeout and the maximum duration,
+	// guarded by m.
+	idle   *time.Timer
+	expiry *time.Timer
+}
+
+// closeReason maps the error returned by a read from the attacker to the
+// close reason reported upstream.
+func closeReason(err error) int {
+	if err == io.EOF {
+		return EOFReasonHalfClose
+	}
+
+	if _, ok := err.(idleTimeoutError); ok {
+		return EOFReasonIdleTimeout
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return EOFReasonTimeout
+	}
+
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNRESET {
+			return EOFReasonRST
+		}
+	}
+
+	return EOFReasonFIN
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// streamID returns the stream id to refer to this session, or zero if the
+// server only supports the legacy protocol.
+func (c *conn) streamID() uint32 {
+	if !c.remote.supports(CapabilityStreamID) {
+		return 0
+	}
+
+	return c.id
+}
+
+// flowControl returns true if the server supports flow control.
+func (c *conn) flowControl() bool {
+	return c.remote.supports(CapabilityFlowControl)
+}
+
+// current returns the current server connection, or nil if the session
+// hasn't been announced on it. The caller must hold c.m.
+func (c *conn) current() *upstream {
+	u := c.remote.current()
+	if u == nil || u.id != c.upstream {
+		return nil
+	}
+
+	return u
+}
+
+// forward sends o to the server, if the session has been announced on the
+// current server connection. The caller must hold c.m.
+func (c *conn) forward(o encoding.BinaryMarshaler) bool {
+	u := c.current()
+	if u == nil {
+		return false
+	}
+
+	return u.send(o)
+}
+
+// forwardData sends data in payloads that fit the frames of the server. The
+// caller must hold c.m.
+func (c *conn) forwardData(data []byte) bool {
+	u := c.current()
+	if u == nil {
+		return false
+	}
+
+	return c.sendData(u, data)
+}
+
+// sendData sends data on u in payloads that fit the frames of the server.
+func (c *conn) sendData(u *upstream, data []byte) bool {
+	for len(data) > 0 {
+		n := len(data)
+		if max := c.remote.maxPayloadSize(); n > max {
+			n = max
+		}
+
+		payload := make([]byte, n)
+		copy(payload, data[:n])
+
+		if !u.send(ReadWrite{
+			Laddr:   c.LocalAddr(),
+			Raddr:   c.RemoteAddr(),
+			ID:      c.streamID(),
+			Payload: payload,
+		}) {
+			return false
+		}
+
+		data = data[n:]
+	}
+
+	return true
 }
 
-func (c *conn) Close() {
-	c.agent.in <- EOF{
+func (c *conn) hello() Hello {
+	return Hello{
+		Token: c.agent.token,
 		Laddr: c.LocalAddr(),
 		Raddr: c.RemoteAddr(),
+		ID:    c.streamID(),
 	}
+}
 
-	c.Conn.Close()
+func (c *conn) eofMessage(reason int) EOF {
+	return EOF{
+		Laddr:  c.LocalAddr(),
+		Raddr:  c.RemoteAddr(),
+		ID:     c.streamID(),
+		Reason: reason,
+	}
 }
 
-func (c *conn) serve() {
-	// TODO: add inactivity timeout
-	defer c.Close()
+// grant adds credit received from the server.
+func (c *conn) grant(n uint32) {
+	c.m.Lock()
+	defer c.m.Unlock()
 
-	c.agent.in <- Hello{
-		Token: c.agent.token,
+	c.credit += int64(n)
+	c.cond.Broadcast()
+}
+
+// waitCredit blocks until the server allows data to be sent, it returns
+// false if the connection has been closed meanwhile.
+func (c *conn) waitCredit() bool {
+	if !c.flowControl() {
+		return true
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for c.credit <= 0 && !c.closed {
+		c.cond.Wait()
+	}
+
+	return !c.closed
+}
+
+// write forwards data read from the attacker to the server. When the
+// session can be resumed the data is kept until acknowledged, write blocks
+// while the resume buffer is full. It returns false if the connection has
+// been closed meanwhile.
+func (c *conn) write(data []byte) bool {
+	c.m.Lock()
+
+	if c.resumable() {
+		for c.sent.Len() > 0 && c.sent.Len()+len(data) > c.agent.config.ResumeBuffer && !c.closed {
+			c.cond.Wait()
+		}
+
+		if c.closed {
+			c.m.Unlock()
+			return false
+		}
+
+		c.sent.Write(data)
+	}
+
+	// the credit can become negative as datagrams can't be split
+	c.credit -= int64(len(data))
+
+	u := c.current()
+	c.m.Unlock()
+
+	// sending blocks while the server connection is congested, the
+	// receive loop needs the lock meanwhile
+	if u != nil {
+		c.sendData(u, data)
+	}
+
+	return true
+}
+
+// enqueue queues data received from the server to be written to the
+// attacker. The overflow policy will be applied if the queue is full, so
+// a slow attacker can't block the other sessions.
+func (c *conn) enqueue(data []byte) {
+	c.m.Lock()
+	c.received += uint64(len(data))
+
+	// keep the order, the backlog is written after the queue
+	if len(c.backlog) > 0 {
+		c.backlog = append(c.backlog, data)
+		c.m.Unlock()
+		return
+	}
+
+	c.m.Unlock()
+
+	select {
+	case c.out <- data:
+		return
+	case <-c.done:
+		return
+	default:
+	}
+
+	switch c.agent.config.Overflow {
+	case OverflowDrop:
+		log.Warningf("Queue of session %d full, dropping %d bytes", c.id, len(data))
+	case OverflowPause:
+		// the server stops sending once the session runs out of credit,
+		// which is only returned after writing to the attacker
+		if !c.flowControl() {
+			log.Warningf("Queue of session %d full, server doesn't support flow control, closing session", c.id)
+			c.terminate(EOFReasonRST)
+			return
+		}
+
+		c.m.Lock()
+		c.backlog = append(c.backlog, data)
+		c.m.Unlock()
+
+		select {
+		case c.more <- struct{}{}:
+		default:
+		}
+	default:
+		log.Warningf("Queue of session %d full, closing session", c.id)
+		c.terminate(EOFReasonRST)
+	}
+}
+
+func (c *conn) emit(t EventType, n int) {
+	c.agent.conns.emit(Event{
+		Type:  t,
+		ID:    c.id,
 		Laddr: c.LocalAddr(),
 		Raddr: c.RemoteAddr(),
+		Bytes: n,
+	})
+}
+
+// terminate closes the connection and notifies Honeytrap.
+func (c *conn) terminate(reason int) {
+	if !c.close(reason) {
+		return
 	}
 
-	go func() {
-		for buf := range c.out {
-			_, err := c.Write(buf)
-			if err == io.EOF {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.forward(c.eofMessage(reason)) {
+		return
+	}
+
+	if c.resumable() {
+		c.remote.suspend(c)
+	}
+}
+
+// eof handles the EOF received from Honeytrap.
+func (c *conn) eof(reason int) {
+	if reason == EOFReasonHalfClose {
+		// the writer will close the write side after the pending data
+		// has been written, without blocking the other sessions
+		c.m.Lock()
+		if !c.halfClosed {
+			c.halfClosed = true
+			close(c.halfClose)
+		}
+		c.m.Unlock()
+
+		return
+	}
+
+	c.close(reason)
+}
+
+// close closes the connection, a reset will be sent to the attacker for
+// EOFReasonRST. It returns false if the connection was already closed.
+func (c *conn) close(reason int) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.closed = true
+	c.reason = reason
+
+	c.stopWatching()
+
+	if c.ticket != nil {
+		c.ticket.release()
+	}
+
+	close(c.done)
+	c.cond.Broadcast()
+
+	if tc, ok := c.Conn.(*net.TCPConn); ok && reason == EOFReasonRST {
+		tc.SetLinger(0)
+	}
+
+	c.Conn.Close()
+
+	c.agent.conns.Remove(c, reason)
+	return true
+}
+
+// closeRead is called when the attacker closed its side of the connection,
+// the connection will be closed when both sides have been closed. Servers
+// without half-close support treat any EOF as a close, the session stays
+// open until the server closes it.
+func (c *conn) closeRead() {
+	c.m.Lock()
+	c.readClosed = true
+	done := c.writeClosed
+	if c.remote.supports(CapabilityHalfClose) {
+		c.forward(c.eofMessage(EOFReasonHalfClose))
+	}
+	c.m.Unlock()
+
+	if done {
+		c.close(EOFReasonFIN)
+	}
+}
+
+// closeWrite is called when Honeytrap closed its side of the connection,
+// the connection will be closed when both sides have been closed.
+func (c *conn) closeWrite() {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+
+	c.m.Lock()
+	c.writeClosed = true
+	done := c.readClosed
+	c.m.Unlock()
+
+	if done {
+		c.close(EOFReasonFIN)
+	}
+}
+
+func (c *conn) writeLoop() {
+	halfClose := c.halfClose
+
+	for {
+		select {
+		case buf := <-c.out:
+			if !c.writeData(buf) {
+				return
+			}
+		case <-c.more:
+			if !c.drain() {
 				return
-			} else if err != nil {
-				log.Error(err.Error())
-				break
 			}
+		case <-halfClose:
+			halfClose = nil
+
+			if !c.drain() {
+				return
+			}
+
+			c.closeWrite()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// drain writes the data queued and the backlog, it returns false if the
+// connection has been closed.
+func (c *conn) drain() bool {
+	for {
+		select {
+		case buf := <-c.out:
+			if !c.writeData(buf) {
+				return false
+			}
+
+			continue
+		default:
 		}
+
+		c.m.Lock()
+		if len(c.backlog) == 0 {
+			c.m.Unlock()
+			return true
+		}
+
+		buf := c.backlog[0]
+		c.backlog[0] = nil
+		c.backlog = c.backlog[1:]
+		c.m.Unlock()
+
+		if !c.writeData(buf) {
+			return false
+		}
+	}
+}
+
+// writeData writes data received from Honeytrap to the attacker, it
+// returns false if the connection has been closed.
+func (c *conn) writeData(buf []byte) bool {
+	allowed := allow(len(buf), c.bytesOut, c.limits.MaxBytesOut)
+
+	n, err := c.Write(buf[:allowed])
+	if err == io.EOF {
+		return false
+	} else if err != nil {
+		log.Error(err.Error())
+		c.terminate(closeReason(err))
+		return false
+	}
+
+	c.bytesOut += int64(n)
+	c.touch()
+
+	c.emit(EventWritten, n)
+
+	if allowed < len(buf) {
+		log.Debugf("Session %d exceeded the limit of %d bytes written", c.id, c.limits.MaxBytesOut)
+		c.terminate(EOFReasonByteLimit)
+		return false
+	}
+
+	if !c.flowControl() {
+		return true
+	}
+
+	// return the credit in batches, to limit the number of window
+	// updates
+	c.consumed += n
+	if c.consumed < InitialWindow/2 {
+		return true
+	}
+
+	c.m.Lock()
+	u := c.current()
+	c.m.Unlock()
+
+	if u != nil {
+		u.send(Window{
+			ID:     c.id,
+			Credit: uint32(c.consumed),
+		})
+	}
+
+	c.consumed = 0
+	return true
+}
+
+func (c *conn) serve() {
+	c.watch()
+
+	c.m.Lock()
+	if u := c.remote.current(); u != nil && u.send(c.hello()) {
+		c.upstream = u.id
+	}
+	c.m.Unlock()
+
+	// the writer stops when the connection has been closed, serve
+	// returns after the writer
+	writer := make(chan struct{})
+	defer func() {
+		<-writer
+	}()
+
+	go func() {
+		defer close(writer)
+
+		c.writeLoop()
 	}()
 
-	func() {
-		buf := make([]byte, 32*1024)
+	buf := make([]byte, 32*1024)
+
+	for {
+		if !c.waitCredit() {
+			return
+		}
 
-		for {
-			nr, er := c.Read(buf)
-			if er == io.EOF {
+		nr, er := c.Read(buf)
+		if er != nil {
+			reason := closeReason(er)
+			if _, ok := c.Conn.(closeWriter); ok && reason == EOFReasonHalfClose {
+				c.closeRead()
 				return
-			} else if er != nil {
-				log.Error(er.Error())
-				break
-			} else if nr == 0 {
-				continue
+			} else if reason == EOFReasonHalfClose {
+				reason = EOFReasonFIN
 			}
 
-			c.agent.in <- ReadWrite{
-				Laddr:   c.LocalAddr(),
-				Raddr:   c.RemoteAddr(),
-				Payload: buf[:nr],
-			}
+			c.terminate(reason)
+			return
+		} else if nr == 0 {
+			continue
 		}
 
-	}()
+		c.touch()
+
+		c.emit(EventRead, nr)
+
+		if !c.throttle(nr) {
+			return
+		}
+
+		allowed := allow(nr, c.bytesIn, c.limits.MaxBytesIn)
+		c.bytesIn += int64(allowed)
+
+		if allowed > 0 && !c.write(buf[:allowed]) {
+			return
+		}
+
+		if allowed < nr {
+			log.Debugf("Session %d exceeded the limit of %d bytes read", c.id, c.limits.MaxBytesIn)
+			c.terminate(EOFReasonByteLimit)
+			return
+		}
+	}
 }
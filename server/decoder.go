@@ -33,9 +33,13 @@ package server
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 )
 
+var ErrInvalidAddress = errors.New("Invalid address")
+
 func NewDecoder(data []byte) *Decoder {
 	return &Decoder{
 		Buffer:    bytes.NewBuffer(data),
@@ -43,81 +47,163 @@ func NewDecoder(data []byte) *Decoder {
 	}
 }
 
+// Decoder reads the fields of a message. After the first error all reads
+// return zero values, the error is kept in LastError.
 type Decoder struct {
 	*bytes.Buffer
 
 	LastError error
 }
 
-func (d *Decoder) ReadData() []byte {
+// read returns the next n bytes, it fails if less than n bytes are left.
+func (d *Decoder) read(n int) []byte {
 	if d.LastError != nil {
-		return []byte{}
+		return nil
 	}
 
-	l := d.ReadUint16()
+	if n > d.Len() {
+		d.LastError = io.ErrUnexpectedEOF
+		return nil
+	}
 
-	buffer := make([]byte, l)
-	if _, err := d.Read(buffer[:]); err != nil {
+	buffer := make([]byte, n)
+	if _, err := io.ReadFull(d.Buffer, buffer); err != nil {
 		d.LastError = err
-		return []byte{}
+		return nil
 	}
 
 	return buffer
 }
 
-func (d *Decoder) ReadString() string {
-	if d.LastError != nil {
-		return ""
+func (d *Decoder) ReadData() []byte {
+	l := d.ReadUint16()
+
+	if buffer := d.read(l); buffer != nil {
+		return buffer
 	}
 
-	l := d.ReadUint16()
+	return []byte{}
+}
 
-	buffer := make([]byte, l)
-	if _, err := d.Read(buffer[:]); err != nil {
-		d.LastError = err
-		return ""
+func (d *Decoder) ReadLongData() []byte {
+	l := d.ReadUint32()
+	if int64(l) > int64(d.Len()) {
+		d.LastError = io.ErrUnexpectedEOF
+	}
+
+	if buffer := d.read(int(l)); buffer != nil {
+		return buffer
 	}
 
-	return string(buffer)
+	return []byte{}
+}
+
+func (d *Decoder) ReadString() string {
+	return string(d.ReadData())
 }
 
 func (d *Decoder) ReadUint16() int {
-	if d.LastError != nil {
+	buffer := d.read(2)
+	if buffer == nil {
 		return 0
 	}
 
-	buffer := [2]byte{}
-	if _, err := d.Read(buffer[:]); err != nil {
-		d.LastError = err
+	return int(binary.LittleEndian.Uint16(buffer))
+}
+
+func (d *Decoder) ReadUint32() uint32 {
+	buffer := d.read(4)
+	if buffer == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(buffer)
+}
+
+func (d *Decoder) ReadUint64() uint64 {
+	buffer := d.read(8)
+	if buffer == nil {
 		return 0
 	}
 
-	return int(binary.LittleEndian.Uint16(buffer[:]))
+	return binary.LittleEndian.Uint64(buffer)
 }
 
 func (d *Decoder) ReadUint8() int {
-	if d.LastError != nil {
+	buffer := d.read(1)
+	if buffer == nil {
 		return 0
 	}
 
-	b, err := d.ReadByte()
-	if err != nil {
-		d.LastError = err
+	return int(buffer[0])
+}
+
+// ReadAddrs reads a list of typed addresses, prefixed with the number of
+// addresses.
+func (d *Decoder) ReadAddrs() []net.Addr {
+	n := d.ReadUint16()
+
+	addresses := []net.Addr{}
+	for i := 0; i < n && d.LastError == nil; i++ {
+		addresses = append(addresses, d.ReadTypedAddr())
+	}
+
+	return addresses
+}
+
+// readIPPort reads the ip and port of an address.
+func (d *Decoder) readIPPort() (net.IP, int) {
+	ip := net.IP(d.ReadData())
+	port := d.ReadUint16()
+
+	if d.LastError != nil {
+		return nil, 0
 	}
 
-	return int(b)
+	if len(ip) != 0 && len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		d.LastError = ErrInvalidAddress
+		return nil, 0
+	}
+
+	return ip, port
 }
 
+// ReadAddr reads an address without type, as used by the legacy protocol,
+// it is always a tcp address.
 func (d *Decoder) ReadAddr() net.Addr {
+	ip, port := d.readIPPort()
 	if d.LastError != nil {
 		return nil
 	}
 
-	ip := net.IP(d.ReadData())
-	port := d.ReadUint16()
-
 	return &net.TCPAddr{
 		IP:   ip,
 		Port: port,
 	}
 }
+
+// ReadTypedAddr reads an address prefixed with its type, tcp or udp.
+func (d *Decoder) ReadTypedAddr() net.Addr {
+	type_ := d.ReadUint8()
+
+	ip, port := d.readIPPort()
+	if d.LastError != nil {
+		return nil
+	}
+
+	switch type_ {
+	case AddrTypeTCP:
+		return &net.TCPAddr{
+			IP:   ip,
+			Port: port,
+		}
+	case AddrTypeUDP:
+		return &net.UDPAddr{
+			IP:   ip,
+			Port: port,
+		}
+	default:
+		d.LastError = ErrInvalidAddress
+		return nil
+	}
+}
@@ -33,11 +33,16 @@ package server
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 )
 
+var ErrDataTooLarge = errors.New("Data too large to encode")
+
 type Encoder struct {
 	bytes.Buffer
+
+	LastError error
 }
 
 func (e *Encoder) WriteUint8(v int) {
@@ -50,22 +55,89 @@ func (e *Encoder) WriteUint16(v int) {
 	e.Write(b[:])
 }
 
+func (e *Encoder) WriteUint32(v uint32) {
+	b := [4]byte{}
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *Encoder) WriteUint64(v uint64) {
+	b := [8]byte{}
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.Write(b[:])
+}
+
 func (e *Encoder) WriteString(s string) {
 	e.WriteData([]byte(s))
 }
 
 func (e *Encoder) WriteData(data []byte) {
+	if len(data) > 0xFFFF {
+		e.LastError = ErrDataTooLarge
+		return
+	}
+
 	e.WriteUint16(len(data))
 	e.Write(data)
 }
 
+// WriteLongData writes data prefixed with a 32 bit length, for data that
+// doesn't fit WriteData.
+func (e *Encoder) WriteLongData(data []byte) {
+	e.WriteUint32(uint32(len(data)))
+	e.Write(data)
+}
+
+// WriteAddrs writes a list of typed addresses, prefixed with the number of
+// addresses.
+func (e *Encoder) WriteAddrs(addresses []net.Addr) {
+	if len(addresses) > 0xFFFF {
+		e.LastError = ErrDataTooLarge
+		return
+	}
+
+	e.WriteUint16(len(addresses))
+
+	for _, address := range addresses {
+		e.WriteTypedAddr(address)
+	}
+}
+
+// WriteAddr writes the ip and port of address, without its type. This is
+// the address format of the legacy protocol, where all sessions are tcp.
 func (e *Encoder) WriteAddr(address net.Addr) {
 	var ip net.IP
 	var port int
 
-	if ta, ok := address.(*net.TCPAddr); ok {
-		ip = ta.IP
-		port = ta.Port
+	switch a := address.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+		port = a.Port
+	case *net.UDPAddr:
+		ip = a.IP
+		port = a.Port
+	}
+
+	e.WriteData(ip)
+	e.WriteUint16(port)
+}
+
+// WriteTypedAddr writes address prefixed with its type, tcp or udp.
+func (e *Encoder) WriteTypedAddr(address net.Addr) {
+	var ip net.IP
+	var port int
+
+	switch a := address.(type) {
+	case *net.TCPAddr:
+		e.WriteUint8(AddrTypeTCP)
+		ip = a.IP
+		port = a.Port
+	case *net.UDPAddr:
+		e.WriteUint8(AddrTypeUDP)
+		ip = a.IP
+		port = a.Port
+	default:
+		e.WriteUint8(AddrTypeTCP)
 	}
 
 	e.WriteData(ip)
@@ -0,0 +1,221 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mimoo/disco/libdisco"
+	"golang.org/x/crypto/scrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// enrollmentPrefix separates the pre-shared key derived from the
+// enrollment code from other uses of the code.
+const enrollmentPrefix = "honeytrap-agent enrollment:"
+
+// The scrypt cost parameters of the enrollment key, deriving a key takes
+// about 100ms and 32MB of memory.
+const (
+	enrollmentN = 1 << 15
+	enrollmentR = 8
+	enrollmentP = 1
+)
+
+// DefaultConfigPath returns the path the configuration is written to on
+// enrollment, and read from if no configuration has been set.
+func DefaultConfigPath() string {
+	return homePath("config.yaml")
+}
+
+// enrollmentKey derives the pre-shared key from the one time enrollment
+// code, the Noise NNpsk2 handshake proves both sides know the code. The
+// code is short, scrypt makes guessing it from a recorded handshake
+// expensive. The salt contains the server host, so guesses can't be
+// precomputed for all servers at once.
+func enrollmentKey(host string, code string) ([]byte, error) {
+	salt := enrollmentPrefix + strings.ToLower(host)
+	return scrypt.Key([]byte(code), []byte(salt), enrollmentN, enrollmentR, enrollmentP, 32)
+}
+
+// Enrollment contains the result of an enrollment.
+type Enrollment struct {
+	// Config is the path of the configuration written.
+	Config string
+
+	Token     string
+	RemoteKey []byte
+}
+
+// Enroll exchanges the one time enrollment code for the credentials of the
+// agent. The token and the server key are stored in the Honeytrap home
+// directory, the configuration received is written to configPath. The key
+// pair of the agent is read from keyPath, or created if it doesn't exist,
+// its public key is sent to the server.
+func Enroll(host string, code string, configPath string, keyPath string) (*Enrollment, error) {
+	if code == "" {
+		return nil, errors.New("No enrollment code set.")
+	}
+
+	address := serverAddress(host)
+
+	config := DefaultConfig()
+
+	kp, err := loadKeyPair(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading key pair: %s", err.Error())
+	}
+
+	serverHost, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid server address %q: %s", host, err.Error())
+	}
+
+	psk, err := enrollmentKey(serverHost, code)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.HandshakeTimeout)
+	defer cancel()
+
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to server: %s: %s", address, err.Error())
+	}
+
+	dc := libdisco.Client(conn, &libdisco.Config{
+		HandshakePattern: libdisco.Noise_NNpsk2,
+		PreSharedKey:     psk,
+	})
+
+	if err := handshake(ctx, dc); err != nil {
+		// the handshake fails if the server doesn't know the code
+		return nil, fmt.Errorf("Enrollment failed: %s: %s", address, err.Error())
+	}
+
+	cc := newAgentConnection(dc)
+	defer cc.Close()
+
+	// the enrollment has to complete within the handshake timeout as well
+	dc.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+
+	hostname, _ := os.Hostname()
+
+	if err := cc.send(EnrollRequest{
+		Version:   Version,
+		Hostname:  hostname,
+		PublicKey: kp.PublicKey[:],
+	}); err != nil {
+		return nil, fmt.Errorf("Error sending enrollment: %s", err.Error())
+	}
+
+	o, err := cc.receive()
+	if err != nil {
+		return nil, fmt.Errorf("Enrollment failed: %s", err.Error())
+	}
+
+	er, ok := o.(*EnrollResponse)
+	if !ok {
+		return nil, fmt.Errorf("Invalid enrollment response: %T", o)
+	}
+
+	if er.Error != "" {
+		return nil, fmt.Errorf("Enrollment refused: %s", er.Error)
+	}
+
+	if er.Token == "" {
+		return nil, errors.New("Enrollment refused: no token received.")
+	}
+
+	if err := config.Load(bytes.NewBuffer(er.Config)); err != nil {
+		return nil, err
+	}
+
+	if config.Host == "" && len(config.Servers) == 0 {
+		config.Host = host
+	}
+
+	// the server knows the public key of this key pair only
+	config.Disco.Key = keyPath
+
+	if len(er.RemoteKey) > 0 {
+		if len(er.RemoteKey) != KeySize {
+			return nil, fmt.Errorf("Invalid remote key received: expected %d bytes, got %d", KeySize, len(er.RemoteKey))
+		}
+
+		keyPath := "server.pub"
+		if err := ioutil.WriteFile(homePath(keyPath), []byte(hex.EncodeToString(er.RemoteKey)), 0644); err != nil {
+			return nil, err
+		}
+
+		if config.RemoteKey == "" && config.RemoteKeyFile == "" {
+			config.RemoteKeyFile = keyPath
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration received: %s", err.Error())
+	}
+
+	if err := ioutil.WriteFile(homePath(config.Token), []byte(er.Token), 0600); err != nil {
+		return nil, err
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(path.Dir(configPath), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(configPath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	return &Enrollment{
+		Config:    configPath,
+		Token:     er.Token,
+		RemoteKey: er.RemoteKey,
+	}, nil
+}
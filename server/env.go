@@ -0,0 +1,185 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the
+// settings of the configuration file.
+const EnvPrefix = "HONEYTRAP_AGENT_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envName returns the environment variable of the setting at path, eg.
+// HONEYTRAP_AGENT_RATE_LIMITS_MAX_DELAY for rate-limits.max-delay.
+func envName(path []string) string {
+	name := strings.Join(path, "_")
+	name = strings.Replace(name, "-", "_", -1)
+	return EnvPrefix + strings.ToUpper(name)
+}
+
+// LoadEnv overrides the settings set in environ, formatted as key=value.
+// Every setting has a variable named after its path in the configuration
+// file, lists are separated by commas. Lists of servers, labels and the
+// settings of specific listeners can only be set in the file.
+func (c *Config) LoadEnv(environ []string) error {
+	env := map[string]string{}
+
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], EnvPrefix) {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	if len(env) == 0 {
+		return nil
+	}
+
+	return loadEnv(reflect.ValueOf(c).Elem(), nil, env)
+}
+
+func loadEnv(v reflect.Value, path []string, env map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		// servers, labels and listeners can't be expressed as a
+		// single value
+		if f.Type.Kind() == reflect.Map || (f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct) {
+			continue
+		}
+
+		fv := v.Field(i)
+
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			p := path
+			if len(tag) < 2 || tag[1] != "inline" {
+				p = append(append([]string{}, path...), tag[0])
+			}
+
+			if err := loadEnv(fv, p, env); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		name := envName(append(append([]string{}, path...), tag[0]))
+
+		s, ok := env[name]
+		if !ok {
+			continue
+		}
+
+		if err := setEnv(fv, s); err != nil {
+			return fmt.Errorf("Invalid value %q for %s: %s", s, name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// setEnv parses s into v, slices are separated by commas.
+func setEnv(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetUint(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+
+		v.SetFloat(n)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setEnv(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+
+		v.Set(slice)
+	default:
+		return fmt.Errorf("Unsupported type %s.", v.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,454 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// ActionDrop closes the connection without forwarding it.
+const ActionDrop = "drop"
+
+// FilterConfig contains the rules deciding which sources are forwarded.
+// Sources matching a deny rule are filtered, when allow rules are
+// configured only sources matching one of them are forwarded.
+type FilterConfig struct {
+	// Action is taken for filtered connections, drop, reject or local.
+	Action string `yaml:"action"`
+
+	// Allow and Deny contain networks in cidr notation, or addresses.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// AllowFile and DenyFile are files containing a network per line,
+	// they are reloaded when changed.
+	AllowFile string `yaml:"allow-file"`
+	DenyFile  string `yaml:"deny-file"`
+
+	// CountryDatabase and ASNDatabase are MaxMind databases used to look
+	// up the country and the autonomous system of a source, eg.
+	// GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb.
+	CountryDatabase string `yaml:"country-database"`
+	ASNDatabase     string `yaml:"asn-database"`
+
+	// AllowCountries and DenyCountries contain ISO 3166 country codes.
+	AllowCountries []string `yaml:"allow-countries"`
+	DenyCountries  []string `yaml:"deny-countries"`
+
+	AllowASNs []uint `yaml:"allow-asns"`
+	DenyASNs  []uint `yaml:"deny-asns"`
+
+	// ReloadInterval is the interval the files are checked for changes.
+	ReloadInterval time.Duration `yaml:"reload-interval"`
+}
+
+// Validate checks the filter for invalid networks and rules missing a
+// database.
+func (c FilterConfig) Validate() error {
+	switch c.Action {
+	case ActionDrop, ActionReject, ActionLocal:
+	default:
+		return fmt.Errorf("Invalid filter action %q, expected drop, reject or local.", c.Action)
+	}
+
+	for _, s := range append(append([]string{}, c.Allow...), c.Deny...) {
+		if _, err := parseNetwork(s); err != nil {
+			return err
+		}
+	}
+
+	for _, code := range append(append([]string{}, c.AllowCountries...), c.DenyCountries...) {
+		if len(code) != 2 {
+			return fmt.Errorf("Invalid country code %q.", code)
+		}
+	}
+
+	if len(c.AllowCountries)+len(c.DenyCountries) > 0 && c.CountryDatabase == "" {
+		return fmt.Errorf("Filtering by country requires a country database.")
+	}
+
+	if len(c.AllowASNs)+len(c.DenyASNs) > 0 && c.ASNDatabase == "" {
+		return fmt.Errorf("Filtering by autonomous system requires an asn database.")
+	}
+
+	if c.ReloadInterval <= 0 {
+		return fmt.Errorf("Invalid filter reload interval %s.", c.ReloadInterval)
+	}
+
+	return nil
+}
+
+// parseNetwork parses a network in cidr notation, or a single address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q.", s)
+		}
+
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid network %q.", s)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// loadNetworks reads the networks in file p, one per line. Empty lines
+// and lines starting with # are ignored.
+func loadNetworks(p string) ([]*net.IPNet, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	networks := []*net.IPNet{}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ipnet, err := parseNetwork(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", p, n, err.Error())
+		}
+
+		networks = append(networks, ipnet)
+	}
+
+	return networks, scanner.Err()
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range networks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterRecord contains the fields looked up in the databases.
+type filterRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// filter applies the filter rules to new connections.
+type filter struct {
+	config FilterConfig
+
+	countries map[string]bool
+	asns      map[uint]bool
+
+	m sync.RWMutex
+
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+
+	countryDB *maxminddb.Reader
+	asnDB     *maxminddb.Reader
+
+	// modified contains the modification times of the files loaded.
+	modified map[string]time.Time
+}
+
+func newFilter(c FilterConfig) (*filter, error) {
+	f := &filter{
+		config:    c,
+		countries: map[string]bool{},
+		asns:      map[uint]bool{},
+		modified:  map[string]time.Time{},
+	}
+
+	// deny rules are stored as false
+	for _, code := range c.AllowCountries {
+		f.countries[strings.ToUpper(code)] = true
+	}
+
+	for _, code := range c.DenyCountries {
+		f.countries[strings.ToUpper(code)] = false
+	}
+
+	for _, asn := range c.AllowASNs {
+		f.asns[asn] = true
+	}
+
+	for _, asn := range c.DenyASNs {
+		f.asns[asn] = false
+	}
+
+	for _, p := range f.files() {
+		if err := f.load(p); err != nil {
+			return nil, fmt.Errorf("Error loading filter: %s", err.Error())
+		}
+	}
+
+	if f.config.AllowFile == "" {
+		f.allowed = f.networks(nil, c.Allow)
+	}
+
+	if f.config.DenyFile == "" {
+		f.denied = f.networks(nil, c.Deny)
+	}
+
+	return f, nil
+}
+
+// files returns the files the filter is loaded from.
+func (f *filter) files() []string {
+	files := []string{}
+
+	for _, p := range []string{f.config.AllowFile, f.config.DenyFile, f.config.CountryDatabase, f.config.ASNDatabase} {
+		if p != "" {
+			files = append(files, p)
+		}
+	}
+
+	return files
+}
+
+// networks returns the networks loaded from a file followed by the
+// configured ones.
+func (f *filter) networks(loaded []*net.IPNet, configured []string) []*net.IPNet {
+	for _, s := range configured {
+		ipnet, _ := parseNetwork(s)
+		loaded = append(loaded, ipnet)
+	}
+
+	return loaded
+}
+
+// load (re)loads file p, replacing the rules loaded from it before.
+func (f *filter) load(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	var networks []*net.IPNet
+	var db *maxminddb.Reader
+
+	switch p {
+	case f.config.AllowFile, f.config.DenyFile:
+		networks, err = loadNetworks(p)
+	default:
+		db, err = maxminddb.Open(p)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	switch p {
+	case f.config.AllowFile:
+		f.allowed = f.networks(networks, f.config.Allow)
+	case f.config.DenyFile:
+		f.denied = f.networks(networks, f.config.Deny)
+	}
+
+	// the same database can contain both the countries and the
+	// autonomous systems
+	closed := map[*maxminddb.Reader]bool{}
+
+	if p == f.config.CountryDatabase {
+		closed[f.countryDB] = true
+		f.countryDB = db
+	}
+
+	if p == f.config.ASNDatabase {
+		closed[f.asnDB] = true
+		f.asnDB = db
+	}
+
+	for r := range closed {
+		if r != nil {
+			r.Close()
+		}
+	}
+
+	f.modified[p] = fi.ModTime()
+	return nil
+}
+
+// reload reloads the files that changed since they were loaded.
+func (f *filter) reload() {
+	for _, p := range f.files() {
+		fi, err := os.Stat(p)
+		if err != nil {
+			log.Errorf("Error checking filter file %s: %s", p, err.Error())
+			continue
+		}
+
+		f.m.RLock()
+		modified := f.modified[p]
+		f.m.RUnlock()
+
+		if fi.ModTime().Equal(modified) {
+			continue
+		}
+
+		if err := f.load(p); err != nil {
+			log.Errorf("Error reloading filter file %s, keeping the previous version: %s", p, err.Error())
+			continue
+		}
+
+		log.Infof("Reloaded filter file %s.", p)
+	}
+}
+
+// restricted returns true if only the sources matching an allow rule are
+// forwarded.
+func (f *filter) restricted() bool {
+	return f.config.AllowFile != "" || len(f.config.Allow) > 0 || len(f.config.AllowCountries) > 0 || len(f.config.AllowASNs) > 0
+}
+
+// lookup returns the country and autonomous system of ip, if known.
+func (f *filter) lookup(ip net.IP) (string, uint) {
+	var country filterRecord
+	if f.countryDB != nil {
+		if err := f.countryDB.Lookup(ip, &country); err != nil {
+			log.Debugf("Error looking up country of %s: %s", ip.String(), err.Error())
+		}
+	}
+
+	var asn filterRecord
+	if f.asnDB != nil {
+		if err := f.asnDB.Lookup(ip, &asn); err != nil {
+			log.Debugf("Error looking up autonomous system of %s: %s", ip.String(), err.Error())
+		}
+	}
+
+	return strings.ToUpper(country.Country.ISOCode), asn.ASN
+}
+
+// check returns the reason a connection from raddr is filtered, or an
+// empty reason if it is forwarded.
+func (f *filter) check(raddr net.Addr) string {
+	ip := hostIP(raddr)
+	if ip == nil {
+		return ""
+	}
+
+	f.m.RLock()
+	defer f.m.RUnlock()
+
+	if containsIP(f.denied, ip) {
+		return "deny"
+	}
+
+	country, asn := f.lookup(ip)
+
+	if allowed, ok := f.countries[country]; ok && !allowed {
+		return "deny-country"
+	}
+
+	if allowed, ok := f.asns[asn]; ok && !allowed {
+		return "deny-asn"
+	}
+
+	if !f.restricted() {
+		return ""
+	}
+
+	if containsIP(f.allowed, ip) || f.countries[country] || f.asns[asn] {
+		return ""
+	}
+
+	return "not-allowed"
+}
+
+// filtered takes the filter action for the connection accepted by the
+// listener on address.
+func (a *Agent) filtered(address net.Addr, rw net.Conn, reason string) {
+	log.Debugf("Filtered connection from %s: %s", rw.RemoteAddr(), reason)
+
+	a.reports.count("filter", reason, a.config.Filter.Action, rw.RemoteAddr())
+
+	switch a.config.Filter.Action {
+	case ActionLocal:
+		a.session(func() {
+			a.serveLocal(rw, a.limits(address))
+		})
+	case ActionReject:
+		reject(rw)
+	default:
+		rw.Close()
+	}
+}
+
+// filterLoop reloads the filter files when changed, every reload interval.
+func (a *Agent) filterLoop(ctx context.Context) {
+	if len(a.filter.files()) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.config.Filter.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		a.filter.reload()
+	}
+}
@@ -0,0 +1,157 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"bytes"
+	"encoding"
+)
+
+// The fuzz targets are run with go-fuzz, using one target per message type
+// and one for the frame reader, eg:
+//
+//	go-fuzz-build -func FuzzReadWrite github.com/honeytrap/honeytrap-agent/server
+//	go-fuzz -bin server-fuzz.zip -workdir fuzz/readwrite
+
+type message interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// fuzzMessage decodes data into o, and verifies the decoded message can be
+// encoded and decoded again.
+func fuzzMessage(o message, n func() message, data []byte) int {
+	if err := o.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+
+	encoded, err := o.MarshalBinary()
+	if err != nil {
+		return 1
+	}
+
+	if err := n().UnmarshalBinary(encoded); err != nil {
+		panic("decoding encoded message failed: " + err.Error())
+	}
+
+	return 1
+}
+
+func FuzzHandshake(data []byte) int {
+	return fuzzMessage(&Handshake{}, func() message { return &Handshake{} }, data)
+}
+
+func FuzzHandshakeResponse(data []byte) int {
+	return fuzzMessage(&HandshakeResponse{}, func() message { return &HandshakeResponse{} }, data)
+}
+
+func FuzzHello(data []byte) int {
+	return fuzzMessage(&Hello{}, func() message { return &Hello{} }, data)
+}
+
+func FuzzPing(data []byte) int {
+	return fuzzMessage(&Ping{}, func() message { return &Ping{} }, data)
+}
+
+func FuzzEOF(data []byte) int {
+	return fuzzMessage(&EOF{}, func() message { return &EOF{} }, data)
+}
+
+func FuzzReadWrite(data []byte) int {
+	return fuzzMessage(&ReadWrite{}, func() message { return &ReadWrite{} }, data)
+}
+
+func FuzzWindow(data []byte) int {
+	return fuzzMessage(&Window{}, func() message { return &Window{} }, data)
+}
+
+func FuzzListenerUpdate(data []byte) int {
+	return fuzzMessage(&ListenerUpdate{}, func() message { return &ListenerUpdate{} }, data)
+}
+
+func FuzzListenerAck(data []byte) int {
+	return fuzzMessage(&ListenerAck{}, func() message { return &ListenerAck{} }, data)
+}
+
+func FuzzPong(data []byte) int {
+	return fuzzMessage(&Pong{}, func() message { return &Pong{} }, data)
+}
+
+func FuzzAck(data []byte) int {
+	return fuzzMessage(&Ack{}, func() message { return &Ack{} }, data)
+}
+
+func FuzzResume(data []byte) int {
+	return fuzzMessage(&Resume{}, func() message { return &Resume{} }, data)
+}
+
+func FuzzEnrollRequest(data []byte) int {
+	return fuzzMessage(&EnrollRequest{}, func() message { return &EnrollRequest{} }, data)
+}
+
+func FuzzEnrollResponse(data []byte) int {
+	return fuzzMessage(&EnrollResponse{}, func() message { return &EnrollResponse{} }, data)
+}
+
+func FuzzError(data []byte) int {
+	return fuzzMessage(&Error{}, func() message { return &Error{} }, data)
+}
+
+func FuzzControl(data []byte) int {
+	return fuzzMessage(&Control{}, func() message { return &Control{} }, data)
+}
+
+func FuzzReport(data []byte) int {
+	return fuzzMessage(&Report{}, func() message { return &Report{} }, data)
+}
+
+// FuzzFrame reads consecutive frames, using legacy framing when the first
+// byte is even and large frames otherwise.
+func FuzzFrame(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+
+	largeFrames := data[0]%2 == 1
+
+	r := bytes.NewReader(data[1:])
+
+	for {
+		if _, err := readFrame(r, largeFrames, 1024*1024); err != nil {
+			break
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,139 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// HeartbeatStats contains the heartbeat statistics of the current server
+// connection.
+type HeartbeatStats struct {
+	// Sent and Received count the pings sent and the pongs received.
+	Sent     uint64
+	Received uint64
+
+	// Missed is the number of pings sent since the last pong.
+	Missed int
+
+	// RTT is the round trip time of the last pong, SmoothedRTT the
+	// weighted average of all round trip times.
+	RTT         time.Duration
+	SmoothedRTT time.Duration
+
+	// LastPong is the time the last pong has been received.
+	LastPong time.Time
+}
+
+// Heartbeat keeps track of the pings sent to the server and the pongs
+// received.
+type Heartbeat struct {
+	m sync.Mutex
+
+	seq   uint32
+	stats HeartbeatStats
+}
+
+// Reset clears the statistics, it is called for every new server
+// connection.
+func (h *Heartbeat) Reset() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.seq = 0
+	h.stats = HeartbeatStats{}
+}
+
+// Ping returns the next ping to send.
+func (h *Heartbeat) Ping(now time.Time) Ping {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.seq++
+	if h.seq == 0 {
+		// zero means no sequence number
+		h.seq++
+	}
+
+	h.stats.Sent++
+	h.stats.Missed++
+
+	return Ping{
+		Seq:       h.seq,
+		Timestamp: now.UnixNano(),
+	}
+}
+
+// Pong registers a pong received from the server and returns the round
+// trip time.
+func (h *Heartbeat) Pong(p *Pong, now time.Time) time.Duration {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	rtt := now.Sub(time.Unix(0, p.Timestamp))
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	h.stats.Received++
+	h.stats.LastPong = now
+
+	// pings sent after the answered one are still in flight
+	if missed := int(h.seq - p.Seq); missed < h.stats.Missed {
+		h.stats.Missed = missed
+	}
+
+	h.stats.RTT = rtt
+
+	if h.stats.SmoothedRTT == 0 {
+		h.stats.SmoothedRTT = rtt
+	} else {
+		h.stats.SmoothedRTT = (7*h.stats.SmoothedRTT + rtt) / 8
+	}
+
+	return rtt
+}
+
+// Missed returns the number of pings sent since the last pong.
+func (h *Heartbeat) Missed() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return h.stats.Missed
+}
+
+func (h *Heartbeat) Stats() HeartbeatStats {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return h.stats
+}
@@ -0,0 +1,159 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mimoo/disco/libdisco"
+)
+
+// KeySize is the size of the disco public and private keys.
+const KeySize = 32
+
+// decodeKey decodes a hex encoded public key.
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", KeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// parseKeyPair parses a key pair in the libdisco format, the hex encoded
+// private key followed by the hex encoded public key.
+func parseKeyPair(data []byte) (*libdisco.KeyPair, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) != KeySize*4 {
+		return nil, fmt.Errorf("expected %d hex characters, got %d", KeySize*4, len(data))
+	}
+
+	var private [KeySize]byte
+	if _, err := hex.Decode(private[:], data[:KeySize*2]); err != nil {
+		return nil, err
+	}
+
+	public, err := decodeKey(string(data[KeySize*2:]))
+	if err != nil {
+		return nil, err
+	}
+
+	kp := libdisco.GenerateKeypair(&private)
+	if !bytes.Equal(kp.PublicKey[:], public) {
+		return nil, fmt.Errorf("public key doesn't match the private key")
+	}
+
+	return kp, nil
+}
+
+// LoadKeyPair reads the key pair from file p, relative paths are resolved
+// against the Honeytrap home directory.
+func LoadKeyPair(p string) (*libdisco.KeyPair, error) {
+	p = homePath(p)
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := parseKeyPair(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key pair %s: %s", p, err.Error())
+	}
+
+	return kp, nil
+}
+
+// GenerateKeyPair generates a new key pair and stores it in file p, an
+// existing file will only be overwritten if force has been set.
+func GenerateKeyPair(p string, force bool) (*libdisco.KeyPair, error) {
+	p = homePath(p)
+
+	if _, err := os.Stat(p); err == nil && !force {
+		return nil, fmt.Errorf("Key pair %s exists already.", p)
+	} else if err == nil {
+		// the key pair is stored read only
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return libdisco.GenerateAndSaveDiscoKeyPair(p)
+}
+
+// loadKeyPair reads the static key pair of the agent from p, a new key pair
+// will be generated and stored if the file doesn't exist.
+func loadKeyPair(p string) (*libdisco.KeyPair, error) {
+	kp, err := LoadKeyPair(p)
+	if os.IsNotExist(err) {
+		log.Infof("Generating new key pair %s.", homePath(p))
+		return GenerateKeyPair(p, false)
+	}
+
+	return kp, err
+}
+
+// loadPublicKey reads a public key from file p, the file contains either the
+// hex encoded public key or a key pair in the libdisco format.
+func loadPublicKey(p string) ([]byte, error) {
+	p = homePath(p)
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == KeySize*4 {
+		kp, err := parseKeyPair(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key pair %s: %s", p, err.Error())
+		}
+
+		return kp.PublicKey[:], nil
+	}
+
+	key, err := decodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key %s: %s", p, err.Error())
+	}
+
+	return key, nil
+}
@@ -0,0 +1,209 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Limits restricts the resources used by a session, zero disables a limit.
+type Limits struct {
+	// IdleTimeout closes sessions without traffic in either direction.
+	IdleTimeout time.Duration `yaml:"idle-timeout"`
+
+	// MaxDuration closes sessions open for longer.
+	MaxDuration time.Duration `yaml:"max-duration"`
+
+	// MaxBytesIn and MaxBytesOut limit the number of bytes read from and
+	// written to the attacker.
+	MaxBytesIn  int64 `yaml:"max-bytes-in"`
+	MaxBytesOut int64 `yaml:"max-bytes-out"`
+}
+
+// ListenerLimits overrides the limits for the sessions accepted by a
+// listener. Unset limits are inherited, zero disables a limit.
+type ListenerLimits struct {
+	IdleTimeout *time.Duration `yaml:"idle-timeout,omitempty"`
+	MaxDuration *time.Duration `yaml:"max-duration,omitempty"`
+	MaxBytesIn  *int64         `yaml:"max-bytes-in,omitempty"`
+	MaxBytesOut *int64         `yaml:"max-bytes-out,omitempty"`
+}
+
+// LimitsConfig contains the limits of all sessions, and the limits of the
+// sessions accepted by specific listeners, eg. tcp/:8022.
+type LimitsConfig struct {
+	Limits `yaml:",inline"`
+
+	Listeners map[string]ListenerLimits `yaml:"listeners"`
+}
+
+// Validate checks the limits for invalid values.
+func (l Limits) Validate() error {
+	if l.IdleTimeout < 0 {
+		return fmt.Errorf("Invalid idle timeout %s.", l.IdleTimeout)
+	}
+
+	if l.MaxDuration < 0 {
+		return fmt.Errorf("Invalid maximum session duration %s.", l.MaxDuration)
+	}
+
+	if l.MaxBytesIn < 0 || l.MaxBytesOut < 0 {
+		return fmt.Errorf("Invalid byte limits %d and %d.", l.MaxBytesIn, l.MaxBytesOut)
+	}
+
+	return nil
+}
+
+// Validate checks the limits for invalid values and listeners.
+func (c LimitsConfig) Validate() error {
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+
+	for port, l := range c.Listeners {
+		if _, err := parseListenAddr(port); err != nil {
+			return fmt.Errorf("Invalid listener %q in limits: %s", port, err.Error())
+		}
+
+		if err := l.inherit(Limits{}).Validate(); err != nil {
+			return fmt.Errorf("Invalid limits for listener %q: %s", port, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// inherit returns the limits, with the unset limits taken from parent.
+func (l ListenerLimits) inherit(parent Limits) Limits {
+	if l.IdleTimeout != nil {
+		parent.IdleTimeout = *l.IdleTimeout
+	}
+
+	if l.MaxDuration != nil {
+		parent.MaxDuration = *l.MaxDuration
+	}
+
+	if l.MaxBytesIn != nil {
+		parent.MaxBytesIn = *l.MaxBytesIn
+	}
+
+	if l.MaxBytesOut != nil {
+		parent.MaxBytesOut = *l.MaxBytesOut
+	}
+
+	return parent
+}
+
+// limits returns the limits of the sessions accepted by the listener on
+// address.
+func (a *Agent) limits(address net.Addr) Limits {
+	for port, l := range a.config.Limits.Listeners {
+		if v, err := parseListenAddr(port); err == nil && listenerKey(v) == listenerKey(address) {
+			return l.inherit(a.config.Limits.Limits)
+		}
+	}
+
+	return a.config.Limits.Limits
+}
+
+// touch records traffic in either direction, postponing the idle timeout.
+func (c *conn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// watch closes the session when it has been idle for too long or exceeds
+// its maximum duration. The timers are stopped when the session closes.
+func (c *conn) watch() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.touch()
+
+	if d := c.limits.IdleTimeout; d > 0 {
+		c.idle = time.AfterFunc(d, c.checkIdle)
+	}
+
+	if d := c.limits.MaxDuration; d > 0 {
+		c.expiry = time.AfterFunc(d, func() {
+			log.Debugf("Session %d exceeded the maximum duration of %s", c.id, d)
+			c.terminate(EOFReasonMaxDuration)
+		})
+	}
+}
+
+// checkIdle closes the session if there hasn't been any traffic within the
+// idle timeout, otherwise it checks again when the timeout would expire.
+func (c *conn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+	if remaining := c.limits.IdleTimeout - idle; remaining > 0 {
+		c.m.Lock()
+		if !c.closed {
+			c.idle.Reset(remaining)
+		}
+		c.m.Unlock()
+		return
+	}
+
+	log.Debugf("Session %d idle for %s, closing", c.id, idle)
+	c.terminate(EOFReasonIdleTimeout)
+}
+
+// stopWatching stops the timers of the session, the caller must hold c.m.
+func (c *conn) stopWatching() {
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+}
+
+// allow returns how many of n bytes may be transferred, given the total
+// transferred before and the limit.
+func allow(n int, total int64, limit int64) int {
+	if limit == 0 {
+		return n
+	}
+
+	if remaining := limit - total; remaining < int64(n) {
+		if remaining < 0 {
+			return 0
+		}
+
+		return int(remaining)
+	}
+
+	return n
+}
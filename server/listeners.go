@@ -0,0 +1,193 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Listeners contains the active listeners, indexed by network and address.
+type Listeners struct {
+	m sync.Mutex
+
+	listeners map[string]net.Listener
+}
+
+func listenerKey(address net.Addr) string {
+	return address.Network() + "/" + address.String()
+}
+
+// Add registers the listener for address, it returns false if there is a
+// listener for address already.
+func (ls *Listeners) Add(address net.Addr, l net.Listener) bool {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	if ls.listeners == nil {
+		ls.listeners = map[string]net.Listener{}
+	}
+
+	key := listenerKey(address)
+	if _, ok := ls.listeners[key]; ok {
+		return false
+	}
+
+	ls.listeners[key] = l
+	return true
+}
+
+func (ls *Listeners) Has(address net.Addr) bool {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	_, ok := ls.listeners[listenerKey(address)]
+	return ok
+}
+
+// Remove unregisters and returns the listener for address, or nil if there
+// is none.
+func (ls *Listeners) Remove(address net.Addr) net.Listener {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	key := listenerKey(address)
+
+	l, ok := ls.listeners[key]
+	if !ok {
+		return nil
+	}
+
+	delete(ls.listeners, key)
+	return l
+}
+
+// Drop unregisters l for address, it returns false if l isn't the listener
+// registered for address, when it has been removed or replaced meanwhile.
+func (ls *Listeners) Drop(address net.Addr, l net.Listener) bool {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	key := listenerKey(address)
+	if v, ok := ls.listeners[key]; !ok || v != l {
+		return false
+	}
+
+	delete(ls.listeners, key)
+	return true
+}
+
+// CloseAll closes and unregisters all listeners.
+func (ls *Listeners) CloseAll() {
+	ls.m.Lock()
+	listeners := ls.listeners
+	ls.listeners = nil
+	ls.m.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// addListener starts listening on address, it is a no-op when the agent is
+// listening on address already.
+func (a *Agent) addListener(address net.Addr) error {
+	if atomic.LoadInt32(&a.stopping) == 1 {
+		return errors.New("Agent is shutting down.")
+	}
+
+	if a.listeners.Has(address) {
+		return nil
+	}
+
+	l, err := listen(address, a.limits(address))
+	if err != nil {
+		return err
+	}
+
+	if !a.listeners.Add(address, l) {
+		l.Close()
+		return nil
+	}
+
+	log.Infof("Listener started: %s/%s", address.Network(), address)
+
+	go a.serv(address, l)
+	return nil
+}
+
+// removeListener stops listening on address. Tcp sessions accepted by the
+// listener stay open, udp sessions share the socket of the listener and
+// are closed with it.
+func (a *Agent) removeListener(address net.Addr) error {
+	l := a.listeners.Remove(address)
+	if l == nil {
+		return fmt.Errorf("Not listening on %s/%s", address.Network(), address)
+	}
+
+	log.Infof("Listener stopped: %s/%s", address.Network(), address)
+
+	return l.Close()
+}
+
+// updateListeners applies the listener changes requested by the server.
+func (a *Agent) updateListeners(u *ListenerUpdate) ListenerAck {
+	ack := ListenerAck{
+		ID:      u.ID,
+		Results: []ListenerResult{},
+	}
+
+	for _, address := range u.Remove {
+		result := ListenerResult{Address: address}
+
+		if err := a.removeListener(address); err != nil {
+			result.Error = err.Error()
+		}
+
+		ack.Results = append(ack.Results, result)
+	}
+
+	for _, address := range u.Add {
+		result := ListenerResult{Address: address}
+
+		if err := a.addListener(address); err != nil {
+			log.Errorf("Error starting listener: %s", err.Error())
+			result.Error = err.Error()
+		}
+
+		ack.Results = append(ack.Results, result)
+	}
+
+	return ack
+}
@@ -0,0 +1,120 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// localSessions contains the connections served locally, without being
+// forwarded to a server.
+type localSessions struct {
+	m     sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (ls *localSessions) add(c net.Conn) {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	if ls.conns == nil {
+		ls.conns = map[net.Conn]struct{}{}
+	}
+
+	ls.conns[c] = struct{}{}
+}
+
+func (ls *localSessions) remove(c net.Conn) {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	delete(ls.conns, c)
+}
+
+// CloseAll closes the connections served locally.
+func (ls *localSessions) CloseAll() {
+	ls.m.Lock()
+	conns := ls.conns
+	ls.conns = nil
+	ls.m.Unlock()
+
+	for c := range conns {
+		c.Close()
+	}
+}
+
+// serveLocal accepts the connection without forwarding it, the data
+// received is discarded until the attacker closes the connection or a
+// session limit applies.
+func (a *Agent) serveLocal(rw net.Conn, limits Limits) {
+	a.local.add(rw)
+
+	defer a.local.remove(rw)
+	defer rw.Close()
+
+	var deadline time.Time
+	if limits.MaxDuration > 0 {
+		deadline = time.Now().Add(limits.MaxDuration)
+	}
+
+	var r io.Reader = rw
+	if limits.MaxBytesIn > 0 {
+		r = io.LimitReader(rw, limits.MaxBytesIn)
+	}
+
+	for {
+		d := deadline
+		if limits.IdleTimeout > 0 {
+			if idle := time.Now().Add(limits.IdleTimeout); d.IsZero() || idle.Before(d) {
+				d = idle
+			}
+		}
+
+		rw.SetReadDeadline(d)
+
+		if n, err := io.CopyN(ioutil.Discard, r, 32*1024); err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// reject closes the connection, with a reset for tcp connections.
+func reject(rw net.Conn) {
+	if tc, ok := rw.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+
+	rw.Close()
+}
@@ -31,7 +31,10 @@
 package server
 
 import (
+	"fmt"
 	"net"
+	"sort"
+	"strings"
 )
 
 const (
@@ -41,26 +44,298 @@ const (
 	TypeEOF               int = 0x04
 	TypeHandshake         int = 0x02
 	TypeHandshakeResponse int = 0x03
+	TypeWindow            int = 0x06
+	TypeListenerUpdate    int = 0x07
+	TypeListenerAck       int = 0x08
+	TypePong              int = 0x09
+	TypeAck               int = 0x0A
+	TypeResume            int = 0x0B
+	TypeEnrollRequest     int = 0x0C
+	TypeEnrollResponse    int = 0x0D
+	TypeError             int = 0x0E
+	TypeControl           int = 0x0F
+	TypeReport            int = 0x10
 )
 
+const (
+	AddrTypeTCP int = 0x00
+	AddrTypeUDP int = 0x01
+)
+
+const (
+	// ProtocolVersion is the highest protocol version supported by the
+	// agent, the version used is negotiated during the handshake.
+	ProtocolVersion = ProtocolCapabilities
+
+	// ProtocolLegacy identifies sessions by their local and remote
+	// address.
+	ProtocolLegacy int = 0x00
+	// ProtocolStreamID identifies sessions by the stream id allocated in
+	// Hello.
+	ProtocolStreamID int = 0x01
+	// ProtocolFlowControl limits the data in flight per session using
+	// credits granted with Window.
+	ProtocolFlowControl int = 0x02
+	// ProtocolLargeFrames uses 32 bit frame lengths after the handshake,
+	// allowing frames up to the negotiated maximum frame size.
+	ProtocolLargeFrames int = 0x03
+	// ProtocolCapabilities exchanges the supported features in the
+	// handshake, instead of deriving them from the version.
+	ProtocolCapabilities int = 0x04
+
+	// InitialWindow is the credit in bytes each side has for a session
+	// when it has been opened.
+	InitialWindow = 256 * 1024
+
+	// LegacyMaxFrameSize is the maximum frame size when large frames
+	// haven't been negotiated.
+	LegacyMaxFrameSize = 0xFFFF
+
+	// frameOverhead is the space reserved for the message fields besides
+	// the payload.
+	frameOverhead = 64
+)
+
+// Capabilities contains the optional protocol features supported by a
+// peer, only the features supported by both sides will be used.
+type Capabilities uint32
+
+const (
+	// CapabilityUDP allows udp sessions.
+	CapabilityUDP Capabilities = 1 << iota
+	// CapabilityStreamID refers to sessions by stream id.
+	CapabilityStreamID
+	// CapabilityFlowControl enables credit based flow control.
+	CapabilityFlowControl
+	// CapabilityLargeFrames enables 32 bit frame lengths.
+	CapabilityLargeFrames
+	// CapabilityCompression is reserved for compressed payloads, which
+	// the agent doesn't support.
+	CapabilityCompression
+	// CapabilityListeners allows the server to start and stop listeners
+	// using ListenerUpdate.
+	CapabilityListeners
+	// CapabilityHeartbeat answers pings with a pong.
+	CapabilityHeartbeat
+	// CapabilityResume keeps sessions open while the connection with the
+	// server is lost, the server acknowledges the data received with Ack
+	// and the sessions are continued using Resume after reconnecting.
+	CapabilityResume
+	// CapabilityControl allows the server to send Control commands.
+	CapabilityControl
+	// CapabilityReports allows the agent to send Report summaries.
+	CapabilityReports
+	// CapabilityHalfClose keeps the session open after an EOF with
+	// EOFReasonHalfClose, until both sides have been closed.
+	CapabilityHalfClose
+)
+
+// AgentCapabilities contains the features supported by the agent.
+const AgentCapabilities = CapabilityUDP | CapabilityStreamID | CapabilityFlowControl | CapabilityLargeFrames | CapabilityListeners | CapabilityHeartbeat | CapabilityResume | CapabilityControl | CapabilityReports | CapabilityHalfClose
+
+var capabilityNames = []struct {
+	c    Capabilities
+	name string
+}{
+	{CapabilityUDP, "udp"},
+	{CapabilityStreamID, "stream-id"},
+	{CapabilityFlowControl, "flow-control"},
+	{CapabilityLargeFrames, "large-frames"},
+	{CapabilityCompression, "compression"},
+	{CapabilityListeners, "listeners"},
+	{CapabilityHeartbeat, "heartbeat"},
+	{CapabilityResume, "resume"},
+	{CapabilityControl, "control"},
+	{CapabilityReports, "reports"},
+	{CapabilityHalfClose, "half-close"},
+}
+
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+func (c Capabilities) String() string {
+	names := []string{}
+
+	for _, v := range capabilityNames {
+		if c.Has(v.c) {
+			names = append(names, v.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ",")
+}
+
+// versionCapabilities returns the features implied by the protocol versions
+// that didn't exchange capabilities.
+func versionCapabilities(version int) Capabilities {
+	caps := Capabilities(0)
+
+	if version >= ProtocolStreamID {
+		caps |= CapabilityUDP | CapabilityStreamID
+	}
+
+	if version >= ProtocolFlowControl {
+		caps |= CapabilityFlowControl
+	}
+
+	if version >= ProtocolLargeFrames {
+		caps |= CapabilityLargeFrames
+	}
+
+	return caps
+}
+
+// negotiate returns the protocol version and the features to use, based on
+// the handshake response of the server.
+func negotiate(hr *HandshakeResponse) (int, Capabilities) {
+	version := hr.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	caps := hr.Capabilities
+	if version < ProtocolCapabilities {
+		caps = versionCapabilities(version)
+	}
+
+	// udp addresses can only be sent in the stream id format, the legacy
+	// format doesn't have address types
+	if !caps.Has(CapabilityStreamID) {
+		caps &^= CapabilityUDP
+	}
+
+	return version, caps & AgentCapabilities
+}
+
 type Handshake struct {
+	Version int
+
+	// MaxFrameSize is the largest frame the agent accepts.
+	MaxFrameSize uint32
+
+	Capabilities Capabilities
+
+	// AgentVersion and CommitID identify the build of the agent.
+	AgentVersion string
+	CommitID     string
+
+	Hostname string
+
+	// OS, Arch and Kernel describe the operating system of the host,
+	// Kernel is empty when unknown.
+	OS     string
+	Arch   string
+	Kernel string
+
+	// Addresses contains the ipv4 and ipv6 addresses of the host.
+	Addresses []net.IP
+
+	// Labels are set by the operator, eg. site, region or customer.
+	Labels map[string]string
 }
 
 func (r *Handshake) UnmarshalBinary(data []byte) error {
 	d := NewDecoder(data)
 
-	_ = d
+	r.Version = ProtocolLegacy
+	if d.Len() > 0 {
+		r.Version = d.ReadUint8()
+	}
+
+	r.MaxFrameSize = LegacyMaxFrameSize
+	if d.Len() > 0 {
+		r.MaxFrameSize = d.ReadUint32()
+	}
+
+	if d.Len() > 0 {
+		r.Capabilities = Capabilities(d.ReadUint32())
+	}
+
+	if d.Len() == 0 {
+		return d.LastError
+	}
+
+	r.AgentVersion = d.ReadString()
+	r.CommitID = d.ReadString()
+	r.Hostname = d.ReadString()
+	r.OS = d.ReadString()
+	r.Arch = d.ReadString()
+	r.Kernel = d.ReadString()
+
+	n := d.ReadUint16()
+
+	r.Addresses = []net.IP{}
+	for i := 0; i < n && d.LastError == nil; i++ {
+		r.Addresses = append(r.Addresses, net.IP(d.ReadData()))
+	}
 
-	return nil
+	n = d.ReadUint16()
+
+	r.Labels = map[string]string{}
+	for i := 0; i < n && d.LastError == nil; i++ {
+		k := d.ReadString()
+		r.Labels[k] = d.ReadString()
+	}
+
+	return d.LastError
 }
 
 func (h Handshake) MarshalBinary() ([]byte, error) {
 	e := Encoder{}
-	return e.Bytes(), nil
+
+	e.WriteUint8(h.Version)
+	e.WriteUint32(h.MaxFrameSize)
+	e.WriteUint32(uint32(h.Capabilities))
+
+	e.WriteString(h.AgentVersion)
+	e.WriteString(h.CommitID)
+	e.WriteString(h.Hostname)
+	e.WriteString(h.OS)
+	e.WriteString(h.Arch)
+	e.WriteString(h.Kernel)
+
+	if len(h.Addresses) > 0xFFFF || len(h.Labels) > 0xFFFF {
+		return nil, ErrDataTooLarge
+	}
+
+	e.WriteUint16(len(h.Addresses))
+	for _, ip := range h.Addresses {
+		e.WriteData(ip)
+	}
+
+	keys := make([]string, 0, len(h.Labels))
+	for k := range h.Labels {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	e.WriteUint16(len(keys))
+	for _, k := range keys {
+		e.WriteString(k)
+		e.WriteString(h.Labels[k])
+	}
+
+	return e.Bytes(), e.LastError
 }
 
 type HandshakeResponse struct {
 	Addresses []net.Addr
+
+	// Version is the protocol version chosen by the server, older
+	// servers don't send a version.
+	Version int
+
+	// MaxFrameSize is the largest frame the server accepts.
+	MaxFrameSize uint32
+
+	// Capabilities contains the features supported by the server.
+	Capabilities Capabilities
 }
 
 func (h *HandshakeResponse) UnmarshalBinary(data []byte) error {
@@ -73,54 +348,122 @@ func (h *HandshakeResponse) UnmarshalBinary(data []byte) error {
 		h.Addresses[i] = d.ReadAddr()
 	}
 
-	return nil
+	h.Version = ProtocolLegacy
+	if d.Len() > 0 {
+		h.Version = d.ReadUint8()
+	}
+
+	h.MaxFrameSize = LegacyMaxFrameSize
+	if d.Len() > 0 {
+		h.MaxFrameSize = d.ReadUint32()
+
+		// udp addresses and the addresses that didn't fit the legacy
+		// address list
+		n := d.ReadUint16()
+		for i := 0; i < n && d.LastError == nil; i++ {
+			h.Addresses = append(h.Addresses, d.ReadTypedAddr())
+		}
+	}
+
+	if d.Len() > 0 {
+		h.Capabilities = Capabilities(d.ReadUint32())
+	}
+
+	return d.LastError
 }
 
 func (h HandshakeResponse) MarshalBinary() ([]byte, error) {
 	e := Encoder{}
-	e.WriteUint8(len(h.Addresses))
+
+	// older agents only read the first 255 addresses, without type,
+	// the other addresses follow the version with their type
+	legacy := []net.Addr{}
+	typed := []net.Addr{}
 
 	for _, address := range h.Addresses {
+		if _, ok := address.(*net.TCPAddr); ok && len(legacy) < 0xFF {
+			legacy = append(legacy, address)
+		} else {
+			typed = append(typed, address)
+		}
+	}
+
+	e.WriteUint8(len(legacy))
+
+	for _, address := range legacy {
 		e.WriteAddr(address)
 	}
 
-	return e.Bytes(), nil
+	e.WriteUint8(h.Version)
+	e.WriteUint32(h.MaxFrameSize)
+
+	e.WriteAddrs(typed)
+
+	e.WriteUint32(uint32(h.Capabilities))
+
+	return e.Bytes(), e.LastError
 }
 
+// Hello announces a new session. When ID is set, the session will be
+// referred to by the stream id instead of its addresses.
 type Hello struct {
 	Token string
 	Laddr net.Addr
 	Raddr net.Addr
+
+	ID uint32
 }
 
 func (h Hello) MarshalBinary() ([]byte, error) {
 	e := Encoder{}
 
-	e.WriteUint8(0)
-
-	e.WriteString(h.Token)
-
-	e.WriteAddr(h.Laddr)
-	e.WriteAddr(h.Raddr)
+	if h.ID == 0 {
+		e.WriteUint8(ProtocolLegacy)
+		e.WriteString(h.Token)
+		e.WriteAddr(h.Laddr)
+		e.WriteAddr(h.Raddr)
+	} else {
+		e.WriteUint8(ProtocolStreamID)
+		e.WriteString(h.Token)
+		e.WriteTypedAddr(h.Laddr)
+		e.WriteTypedAddr(h.Raddr)
+		e.WriteUint32(h.ID)
+	}
 
-	return e.Bytes(), nil
+	return e.Bytes(), e.LastError
 }
 
 func (h *Hello) UnmarshalBinary(data []byte) error {
 	decoder := NewDecoder(data)
 
-	_ = decoder.ReadUint8() /* protocol */
+	protocol := decoder.ReadUint8()
 
 	h.Token = decoder.ReadString()
-	h.Laddr = decoder.ReadAddr()
-	h.Raddr = decoder.ReadAddr()
-	return nil
+
+	if protocol >= ProtocolStreamID {
+		h.Laddr = decoder.ReadTypedAddr()
+		h.Raddr = decoder.ReadTypedAddr()
+		h.ID = decoder.ReadUint32()
+	} else {
+		h.Laddr = decoder.ReadAddr()
+		h.Raddr = decoder.ReadAddr()
+	}
+
+	return decoder.LastError
 }
 
+// Ping is sent periodically, peers supporting heartbeats answer pings with
+// a Seq with a Pong.
 type Ping struct {
 	Token string
 	Laddr net.Addr
 	Raddr net.Addr
+
+	Seq uint32
+
+	// Timestamp contains the time the ping was sent in nanoseconds since
+	// the unix epoch, it will be echoed in the pong.
+	Timestamp int64
 }
 
 func (h *Ping) UnmarshalBinary(data []byte) error {
@@ -131,7 +474,14 @@ func (h *Ping) UnmarshalBinary(data []byte) error {
 	h.Token = decoder.ReadString()
 	h.Laddr = decoder.ReadAddr()
 	h.Raddr = decoder.ReadAddr()
-	return nil
+
+	// older versions don't send a sequence number
+	if decoder.Len() > 0 {
+		h.Seq = decoder.ReadUint32()
+		h.Timestamp = int64(decoder.ReadUint64())
+	}
+
+	return decoder.LastError
 }
 
 func (h Ping) MarshalBinary() ([]byte, error) {
@@ -144,65 +494,631 @@ func (h Ping) MarshalBinary() ([]byte, error) {
 	e.WriteAddr(h.Laddr)
 	e.WriteAddr(h.Raddr)
 
-	return e.Bytes(), nil
+	if h.Seq != 0 {
+		e.WriteUint32(h.Seq)
+		e.WriteUint64(uint64(h.Timestamp))
+	}
+
+	return e.Bytes(), e.LastError
+}
+
+// Pong answers the Ping with the same Seq, echoing its Timestamp.
+type Pong struct {
+	Seq       uint32
+	Timestamp int64
+}
+
+func (h *Pong) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	h.Seq = decoder.ReadUint32()
+	h.Timestamp = int64(decoder.ReadUint64())
+
+	return decoder.LastError
 }
 
+func (h Pong) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint32(h.Seq)
+	e.WriteUint64(uint64(h.Timestamp))
+
+	return e.Bytes(), e.LastError
+}
+
+// Close reasons, as sent in the EOF message.
+const (
+	// EOFReasonFIN indicates an orderly close of the connection.
+	EOFReasonFIN int = 0x00
+	// EOFReasonHalfClose indicates no more data will be sent, while data
+	// can still be received.
+	EOFReasonHalfClose int = 0x01
+	// EOFReasonRST indicates the connection has been reset.
+	EOFReasonRST int = 0x02
+	// EOFReasonTimeout indicates the connection has timed out.
+	EOFReasonTimeout int = 0x03
+	// EOFReasonShutdown indicates the agent is shutting down.
+	EOFReasonShutdown int = 0x04
+	// EOFReasonIdleTimeout indicates the session has been idle for longer
+	// than the idle timeout.
+	EOFReasonIdleTimeout int = 0x05
+	// EOFReasonMaxDuration indicates the session exceeded the maximum
+	// session duration.
+	EOFReasonMaxDuration int = 0x06
+	// EOFReasonByteLimit indicates the session exceeded the maximum number
+	// of bytes in either direction.
+	EOFReasonByteLimit int = 0x07
+)
+
+// EOF closes a session, it refers to the session by ID when set, otherwise
+// by its addresses.
 type EOF struct {
 	Laddr net.Addr
 	Raddr net.Addr
+
+	ID uint32
+
+	Reason int
 }
 
 func (r *EOF) UnmarshalBinary(data []byte) error {
 	decoder := NewDecoder(data)
 
-	decoder.ReadUint8()
+	if protocol := decoder.ReadUint8(); protocol >= ProtocolStreamID {
+		r.ID = decoder.ReadUint32()
+	} else {
+		r.Laddr = decoder.ReadAddr()
+		r.Raddr = decoder.ReadAddr()
+	}
 
-	r.Laddr = decoder.ReadAddr()
-	r.Raddr = decoder.ReadAddr()
+	// older versions don't send the close reason
+	r.Reason = EOFReasonFIN
+	if decoder.Len() > 0 {
+		r.Reason = decoder.ReadUint8()
+	}
 
-	return nil
+	return decoder.LastError
 }
 
 func (h EOF) MarshalBinary() ([]byte, error) {
 	e := Encoder{}
 
-	e.WriteUint8(0)
+	if h.ID == 0 {
+		e.WriteUint8(ProtocolLegacy)
+		e.WriteAddr(h.Laddr)
+		e.WriteAddr(h.Raddr)
+	} else {
+		e.WriteUint8(ProtocolStreamID)
+		e.WriteUint32(h.ID)
+	}
 
-	e.WriteAddr(h.Laddr)
-	e.WriteAddr(h.Raddr)
+	e.WriteUint8(h.Reason)
 
-	return e.Bytes(), nil
+	return e.Bytes(), e.LastError
 }
 
+// ReadWrite contains the data of a session, it refers to the session by ID
+// when set, otherwise by its addresses.
 type ReadWrite struct {
 	Laddr net.Addr
 	Raddr net.Addr
 
+	ID uint32
+
 	Payload []byte
 }
 
 func (h ReadWrite) MarshalBinary() ([]byte, error) {
 	e := Encoder{}
 
-	e.WriteUint8(0)
+	if h.ID == 0 {
+		e.WriteUint8(ProtocolLegacy)
+		e.WriteAddr(h.Laddr)
+		e.WriteAddr(h.Raddr)
+		e.WriteData(h.Payload)
+	} else if len(h.Payload) > 0xFFFF {
+		e.WriteUint8(ProtocolLargeFrames)
+		e.WriteUint32(h.ID)
+		e.WriteLongData(h.Payload)
+	} else {
+		e.WriteUint8(ProtocolStreamID)
+		e.WriteUint32(h.ID)
+		e.WriteData(h.Payload)
+	}
 
-	e.WriteAddr(h.Laddr)
-	e.WriteAddr(h.Raddr)
+	return e.Bytes(), e.LastError
+}
 
-	e.WriteData(h.Payload)
+func (r *ReadWrite) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
 
-	return e.Bytes(), nil
+	protocol := decoder.ReadUint8()
+	if protocol >= ProtocolStreamID {
+		r.ID = decoder.ReadUint32()
+	} else {
+		r.Laddr = decoder.ReadAddr()
+		r.Raddr = decoder.ReadAddr()
+	}
+
+	if protocol >= ProtocolLargeFrames {
+		r.Payload = decoder.ReadLongData()
+	} else {
+		r.Payload = decoder.ReadData()
+	}
+
+	return decoder.LastError
 }
 
-func (r *ReadWrite) UnmarshalBinary(data []byte) error {
+// Window grants the peer credit to send Credit more bytes for the session.
+type Window struct {
+	ID     uint32
+	Credit uint32
+}
+
+func (h Window) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolFlowControl)
+
+	e.WriteUint32(h.ID)
+	e.WriteUint32(h.Credit)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *Window) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.ID = decoder.ReadUint32()
+	r.Credit = decoder.ReadUint32()
+
+	return decoder.LastError
+}
+
+// Ack acknowledges the data of the session received by the server, all
+// bytes before Offset can be discarded by the agent.
+type Ack struct {
+	ID     uint32
+	Offset uint64
+}
+
+func (h Ack) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint32(h.ID)
+	e.WriteUint64(h.Offset)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *Ack) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.ID = decoder.ReadUint32()
+	r.Offset = decoder.ReadUint64()
+
+	return decoder.LastError
+}
+
+// Resume re-announces a session after reconnecting. The data following
+// Resume starts at Offset of the stream, data the server received already
+// should be skipped. Received contains the number of bytes the agent
+// received from the server, the server should replay the data after it.
+// The flow control windows of both sides restart at InitialWindow.
+type Resume struct {
+	ID    uint32
+	Laddr net.Addr
+	Raddr net.Addr
+
+	Offset   uint64
+	Received uint64
+}
+
+func (h Resume) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint32(h.ID)
+	e.WriteTypedAddr(h.Laddr)
+	e.WriteTypedAddr(h.Raddr)
+	e.WriteUint64(h.Offset)
+	e.WriteUint64(h.Received)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *Resume) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.ID = decoder.ReadUint32()
+	r.Laddr = decoder.ReadTypedAddr()
+	r.Raddr = decoder.ReadTypedAddr()
+	r.Offset = decoder.ReadUint64()
+	r.Received = decoder.ReadUint64()
+
+	return decoder.LastError
+}
+
+// EnrollRequest requests the credentials of a new agent, it is sent instead of the
+// Handshake on enrollment connections.
+type EnrollRequest struct {
+	// Version contains the version of the agent.
+	Version  string
+	Hostname string
+
+	// PublicKey contains the static public key of the agent.
+	PublicKey []byte
+}
+
+func (h EnrollRequest) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteString(h.Version)
+	e.WriteString(h.Hostname)
+	e.WriteData(h.PublicKey)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *EnrollRequest) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.Version = decoder.ReadString()
+	r.Hostname = decoder.ReadString()
+	r.PublicKey = decoder.ReadData()
+
+	return decoder.LastError
+}
+
+// EnrollResponse contains the credentials of the agent, or the reason the
+// enrollment has been refused in Error.
+type EnrollResponse struct {
+	Error string
+
+	Token string
+
+	// RemoteKey contains the public key of the server.
+	RemoteKey []byte
+
+	// Config contains the initial yaml configuration of the agent.
+	Config []byte
+}
+
+func (h EnrollResponse) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteString(h.Error)
+	e.WriteString(h.Token)
+	e.WriteData(h.RemoteKey)
+	e.WriteData(h.Config)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *EnrollResponse) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.Error = decoder.ReadString()
+	r.Token = decoder.ReadString()
+	r.RemoteKey = decoder.ReadData()
+	r.Config = decoder.ReadData()
+
+	return decoder.LastError
+}
+
+// ListenerUpdate requests the agent to start and stop listeners, the agent
+// replies with a ListenerAck with the same ID.
+type ListenerUpdate struct {
+	ID uint32
+
+	Add    []net.Addr
+	Remove []net.Addr
+}
+
+func (h ListenerUpdate) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint32(h.ID)
+	e.WriteAddrs(h.Add)
+	e.WriteAddrs(h.Remove)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *ListenerUpdate) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.ID = decoder.ReadUint32()
+	r.Add = decoder.ReadAddrs()
+	r.Remove = decoder.ReadAddrs()
+
+	return decoder.LastError
+}
+
+// ListenerResult contains the result of starting or stopping the listener
+// for Address, Error is empty on success.
+type ListenerResult struct {
+	Address net.Addr
+	Error   string
+}
+
+// ListenerAck reports the results of the ListenerUpdate with the same ID.
+type ListenerAck struct {
+	ID uint32
+
+	Results []ListenerResult
+}
+
+func (h ListenerAck) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint32(h.ID)
+
+	if len(h.Results) > 0xFFFF {
+		e.LastError = ErrDataTooLarge
+	}
+
+	e.WriteUint16(len(h.Results))
+
+	for _, result := range h.Results {
+		e.WriteTypedAddr(result.Address)
+		e.WriteString(result.Error)
+	}
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *ListenerAck) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.ID = decoder.ReadUint32()
+
+	n := decoder.ReadUint16()
+
+	r.Results = []ListenerResult{}
+	for i := 0; i < n && decoder.LastError == nil; i++ {
+		r.Results = append(r.Results, ListenerResult{
+			Address: decoder.ReadTypedAddr(),
+			Error:   decoder.ReadString(),
+		})
+	}
+
+	return decoder.LastError
+}
+
+// Error codes sent by the server using Error.
+const (
+	// ErrorInternal is a failure of the server, the agent reconnects.
+	ErrorInternal int = 0x00
+	// ErrorInvalidToken rejects the token of the agent, the agent stops
+	// connecting to the server.
+	ErrorInvalidToken int = 0x01
+	// ErrorUnsupportedVersion rejects the protocol version of the agent,
+	// the agent stops connecting to the server.
+	ErrorUnsupportedVersion int = 0x02
+	// ErrorRetryAfter asks the agent to reconnect after RetryAfter
+	// seconds, eg. when the server is overloaded.
+	ErrorRetryAfter int = 0x03
+)
+
+// Error is sent by the server when it rejects the agent, instead of the
+// HandshakeResponse or at any time after. The server closes the connection
+// after sending it.
+type Error struct {
+	Code    int
+	Message string
+
+	// RetryAfter is the number of seconds the agent waits before
+	// reconnecting, zero uses the default delay.
+	RetryAfter uint32
+}
+
+func (h Error) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint16(h.Code)
+	e.WriteString(h.Message)
+	e.WriteUint32(h.RetryAfter)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *Error) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.Code = decoder.ReadUint16()
+	r.Message = decoder.ReadString()
+	r.RetryAfter = decoder.ReadUint32()
+
+	return decoder.LastError
+}
+
+func (h Error) String() string {
+	switch h.Code {
+	case ErrorInternal:
+		return "internal error"
+	case ErrorInvalidToken:
+		return "invalid token"
+	case ErrorUnsupportedVersion:
+		return "unsupported version"
+	case ErrorRetryAfter:
+		return "retry after"
+	default:
+		return fmt.Sprintf("error %d", h.Code)
+	}
+}
+
+// Control commands sent by the server using Control.
+const (
+	// ControlGoAway asks the agent to disconnect, eg. when the server is
+	// shutting down. New sessions are forwarded to the other servers, the
+	// agent reconnects after RetryAfter seconds. The agent sends it to the
+	// server when it is shutting down itself.
+	ControlGoAway int = 0x00
+	// ControlLogLevel sets the log level of the agent to Value.
+	ControlLogLevel int = 0x01
+)
+
+// Control contains a command from the server, or the go away of the agent.
+// It is only sent when the Control capability has been negotiated.
+type Control struct {
+	Command int
+
+	RetryAfter uint32
+
+	Value string
+}
+
+func (h Control) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint8(h.Command)
+	e.WriteUint32(h.RetryAfter)
+	e.WriteString(h.Value)
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *Control) UnmarshalBinary(data []byte) error {
+	decoder := NewDecoder(data)
+
+	decoder.ReadUint8()
+
+	r.Command = decoder.ReadUint8()
+	r.RetryAfter = decoder.ReadUint32()
+	r.Value = decoder.ReadString()
+
+	return decoder.LastError
+}
+
+// ReportCounter counts the connections handled by the agent itself, by the
+// stage, the reason and the action taken.
+type ReportCounter struct {
+	// Stage is the stage that handled the connections, eg. rate-limit.
+	Stage string
+
+	// Reason describes the limit or rule that applied, eg. source-rate.
+	Reason string
+
+	// Action is the action taken, eg. reject, delay or local.
+	Action string
+
+	Count uint64
+}
+
+// ReportSource counts the connections from a source handled by the agent
+// itself.
+type ReportSource struct {
+	IP    net.IP
+	Count uint64
+}
+
+// Report summarizes the connections handled by the agent itself instead of
+// being forwarded, since the previous report. It is only sent when the
+// Reports capability has been negotiated.
+type Report struct {
+	// Period is the number of seconds covered by the report.
+	Period uint32
+
+	Counters []ReportCounter
+
+	// Sources contains the sources with the most connections.
+	Sources []ReportSource
+}
+
+func (h Report) MarshalBinary() ([]byte, error) {
+	e := Encoder{}
+
+	e.WriteUint8(ProtocolCapabilities)
+
+	e.WriteUint32(h.Period)
+
+	if len(h.Counters) > 0xFFFF || len(h.Sources) > 0xFFFF {
+		e.LastError = ErrDataTooLarge
+	}
+
+	e.WriteUint16(len(h.Counters))
+
+	for _, c := range h.Counters {
+		e.WriteString(c.Stage)
+		e.WriteString(c.Reason)
+		e.WriteString(c.Action)
+		e.WriteUint64(c.Count)
+	}
+
+	e.WriteUint16(len(h.Sources))
+
+	for _, s := range h.Sources {
+		e.WriteData(s.IP)
+		e.WriteUint64(s.Count)
+	}
+
+	return e.Bytes(), e.LastError
+}
+
+func (r *Report) UnmarshalBinary(data []byte) error {
 	decoder := NewDecoder(data)
 
 	decoder.ReadUint8()
 
-	r.Laddr = decoder.ReadAddr()
-	r.Raddr = decoder.ReadAddr()
+	r.Period = decoder.ReadUint32()
 
-	r.Payload = decoder.ReadData()
+	n := decoder.ReadUint16()
+
+	r.Counters = []ReportCounter{}
+	for i := 0; i < n && decoder.LastError == nil; i++ {
+		r.Counters = append(r.Counters, ReportCounter{
+			Stage:  decoder.ReadString(),
+			Reason: decoder.ReadString(),
+			Action: decoder.ReadString(),
+			Count:  decoder.ReadUint64(),
+		})
+	}
+
+	n = decoder.ReadUint16()
+
+	r.Sources = []ReportSource{}
+	for i := 0; i < n && decoder.LastError == nil; i++ {
+		r.Sources = append(r.Sources, ReportSource{
+			IP:    net.IP(decoder.ReadData()),
+			Count: decoder.ReadUint64(),
+		})
+	}
 
-	return nil
+	return decoder.LastError
 }
@@ -0,0 +1,185 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// legacyData returns data prefixed with its 16 bit length.
+func legacyData(data []byte) []byte {
+	b := make([]byte, 2, 2+len(data))
+	binary.LittleEndian.PutUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// legacyAddr returns an address in the format of the legacy protocol, the
+// ip and port without address type.
+func legacyAddr(ip net.IP, port int) []byte {
+	p := [2]byte{}
+	binary.LittleEndian.PutUint16(p[:], uint16(port))
+	return append(legacyData(ip), p[:]...)
+}
+
+func TestLegacyHandshakeResponse(t *testing.T) {
+	// a handshake response of a server that doesn't negotiate versions
+	data := []byte{2}
+	data = append(data, legacyAddr(net.IPv4(0, 0, 0, 0).To4(), 22)...)
+	data = append(data, legacyAddr(nil, 8080)...)
+
+	hr := HandshakeResponse{}
+	if err := hr.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Error decoding legacy handshake response: %s", err.Error())
+	}
+
+	expected := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(0, 0, 0, 0).To4(), Port: 22},
+		&net.TCPAddr{IP: net.IP{}, Port: 8080},
+	}
+
+	if !reflect.DeepEqual(hr.Addresses, expected) {
+		t.Fatalf("Expected addresses %v, got %v", expected, hr.Addresses)
+	}
+
+	if hr.Version != ProtocolLegacy || hr.MaxFrameSize != LegacyMaxFrameSize {
+		t.Fatalf("Expected legacy version and frame size, got %d and %d", hr.Version, hr.MaxFrameSize)
+	}
+
+	version, caps := negotiate(&hr)
+	if version != ProtocolLegacy || caps != 0 {
+		t.Fatalf("Expected legacy protocol without capabilities, got version %d with %s", version, caps)
+	}
+}
+
+func TestHandshakeResponseAddresses(t *testing.T) {
+	hr := HandshakeResponse{
+		Addresses: []net.Addr{
+			&net.TCPAddr{IP: net.IP{}, Port: 22},
+			&net.UDPAddr{IP: net.IP{}, Port: 53},
+		},
+		Version:      ProtocolCapabilities,
+		MaxFrameSize: 1 << 20,
+		Capabilities: AgentCapabilities,
+	}
+
+	data, err := hr.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding handshake response: %s", err.Error())
+	}
+
+	// agents without versions only read the tcp addresses
+	legacy := []byte{1}
+	legacy = append(legacy, legacyAddr(net.IP{}, 22)...)
+
+	if !bytes.HasPrefix(data, legacy) {
+		t.Fatalf("Expected legacy address list %x, got %x", legacy, data)
+	}
+
+	decoded := HandshakeResponse{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Error decoding handshake response: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(decoded, hr) {
+		t.Fatalf("Expected %#v, got %#v", hr, decoded)
+	}
+}
+
+func TestLegacyMessages(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 22}
+	raddr := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7).To4(), Port: 51234}
+
+	hello := []byte{byte(ProtocolLegacy)}
+	hello = append(hello, legacyData([]byte("token"))...)
+	hello = append(hello, legacyAddr(laddr.IP, laddr.Port)...)
+	hello = append(hello, legacyAddr(raddr.IP, raddr.Port)...)
+
+	readWrite := []byte{byte(ProtocolLegacy)}
+	readWrite = append(readWrite, legacyAddr(laddr.IP, laddr.Port)...)
+	readWrite = append(readWrite, legacyAddr(raddr.IP, raddr.Port)...)
+	readWrite = append(readWrite, legacyData([]byte("SSH-2.0-OpenSSH\r\n"))...)
+
+	tests := []struct {
+		name     string
+		message  encoding.BinaryMarshaler
+		expected []byte
+		decoded  encoding.BinaryUnmarshaler
+	}{
+		{
+			name:     "hello",
+			message:  Hello{Token: "token", Laddr: laddr, Raddr: raddr},
+			expected: hello,
+			decoded:  &Hello{},
+		},
+		{
+			name:     "readwrite",
+			message:  ReadWrite{Laddr: laddr, Raddr: raddr, Payload: []byte("SSH-2.0-OpenSSH\r\n")},
+			expected: readWrite,
+			decoded:  &ReadWrite{},
+		},
+	}
+
+	for _, test := range tests {
+		data, err := test.message.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: error encoding: %s", test.name, err.Error())
+		}
+
+		if !bytes.Equal(data, test.expected) {
+			t.Fatalf("%s: expected legacy encoding %x, got %x", test.name, test.expected, data)
+		}
+
+		if err := test.decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: error decoding: %s", test.name, err.Error())
+		}
+
+		if decoded := reflect.ValueOf(test.decoded).Elem().Interface(); !reflect.DeepEqual(decoded, test.message) {
+			t.Fatalf("%s: expected %#v, got %#v", test.name, test.message, decoded)
+		}
+	}
+}
+
+func TestNegotiateUDP(t *testing.T) {
+	// udp addresses can't be sent without stream ids
+	_, caps := negotiate(&HandshakeResponse{
+		Version:      ProtocolCapabilities,
+		Capabilities: CapabilityUDP | CapabilityHeartbeat,
+	})
+
+	if caps != CapabilityHeartbeat {
+		t.Fatalf("Expected capabilities heartbeat, got %s", caps)
+	}
+}
@@ -31,16 +31,16 @@
 package server
 
 import (
-	"encoding/hex"
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
+	"strings"
 
 	_ "net/http/pprof"
 
-	"net"
-
 	"github.com/rs/xid"
 )
 
@@ -52,11 +52,8 @@ func WithConfig(s string) (OptionFn, error) {
 		return nil, err
 	}
 
-	_ = data
-
 	return func(b *Agent) error {
-		return nil
-		// return b.config.Load(bytes.NewBuffer(data))
+		return b.config.Load(bytes.NewBuffer(data))
 	}, nil
 }
 
@@ -86,45 +83,126 @@ func HomeDir() string {
 }
 
 func WithKey(key string) OptionFn {
-	v, _ := hex.DecodeString(key)
+	return func(h *Agent) error {
+		h.config.RemoteKey = key
+		return nil
+	}
+}
 
+// WithRemoteKeyFile sets the file containing the remote key of the server.
+func WithRemoteKeyFile(p string) OptionFn {
 	return func(h *Agent) error {
-		h.RemoteKey = v
+		h.config.RemoteKeyFile = p
+		return nil
+	}
+}
+
+// WithKeyPair sets the file containing the static key pair of the agent.
+func WithKeyPair(p string) OptionFn {
+	return func(h *Agent) error {
+		h.config.Disco.Key = p
 		return nil
 	}
 }
 
 func WithServer(server string) OptionFn {
-	host, port, _ := net.SplitHostPort(server)
-	if port == "" {
-		port = "1337"
+	return func(h *Agent) error {
+		h.config.Host = server
+		return nil
 	}
+}
 
+// WithEnv overrides the settings set by the HONEYTRAP_AGENT_ environment
+// variables in environ, see Config.LoadEnv.
+func WithEnv(environ []string) OptionFn {
 	return func(h *Agent) error {
-		h.Server = net.JoinHostPort(host, port)
+		return h.config.LoadEnv(environ)
+	}
+}
+
+// WithServers sets the servers used besides the primary server, in order
+// of preference.
+func WithServers(servers ...ServerConfig) OptionFn {
+	return func(h *Agent) error {
+		h.config.Servers = servers
 		return nil
 	}
 }
 
-func WithToken() OptionFn {
-	uid := xid.New().String()
+// WithTransport sets the transport used to connect to the servers,
+// overriding the configured transport.
+func WithTransport(t Transport) OptionFn {
+	return func(h *Agent) error {
+		h.transport = t
+		return nil
+	}
+}
 
-	p := HomeDir()
-	p = path.Join(p, "token")
+// WithToken sets the path of the token file.
+func WithToken(p string) OptionFn {
+	return func(h *Agent) error {
+		h.config.Token = p
+		return nil
+	}
+}
 
-	if _, err := os.Stat(p); os.IsNotExist(err) {
-		ioutil.WriteFile(p, []byte(uid), 0600)
-	} else if err != nil {
-		// other error
-		panic(err)
-	} else if data, err := ioutil.ReadFile(p); err == nil {
-		uid = string(data)
-	} else {
-		panic(err)
+func WithLogLevel(level string) OptionFn {
+	return func(h *Agent) error {
+		h.config.LogLevel = level
+		return nil
 	}
+}
 
+// WithListeners sets the listeners that will be started besides the
+// addresses received from the server.
+func WithListeners(ports ...string) OptionFn {
 	return func(h *Agent) error {
-		h.token = uid
+		h.config.Ports = ports
+		return nil
+	}
+}
+
+// WithLabels adds the labels sent to the server, formatted as name=value.
+func WithLabels(labels ...string) OptionFn {
+	return func(h *Agent) error {
+		if h.config.Labels == nil {
+			h.config.Labels = map[string]string{}
+		}
+
+		for _, label := range labels {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid label %q, expected name=value.", label)
+			}
+
+			h.config.Labels[parts[0]] = parts[1]
+		}
+
 		return nil
 	}
 }
+
+// homePath resolves relative paths against the Honeytrap home directory.
+func homePath(p string) string {
+	if p == "" || path.IsAbs(p) {
+		return p
+	}
+
+	return path.Join(HomeDir(), p)
+}
+
+// loadToken reads the agent token from p, a new token will be generated
+// and stored if the file doesn't exist.
+func loadToken(p string) (string, error) {
+	p = homePath(p)
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		uid := xid.New().String()
+		return uid, ioutil.WriteFile(p, []byte(uid), 0600)
+	} else if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,597 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions taken when a rate limit trips.
+const (
+	// ActionReject closes the connection with a reset.
+	ActionReject = "reject"
+	// ActionDelay waits until the limit allows the connection, up to the
+	// maximum delay, after which the connection is rejected.
+	ActionDelay = "delay"
+	// ActionLocal accepts the connection without forwarding it.
+	ActionLocal = "local"
+)
+
+// sessionRetryInterval is the interval delayed connections are checked
+// against the session limits again.
+const sessionRetryInterval = 250 * time.Millisecond
+
+// minSourcesExpiry is the number of sources tracked before idle sources are
+// expired while admitting connections.
+const minSourcesExpiry = 1024
+
+// RateLimit limits the sessions of a source, a listener or the agent, zero
+// disables a limit.
+type RateLimit struct {
+	// Rate is the number of new connections allowed per second, with
+	// bursts of up to Burst connections.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	// MaxSessions is the number of concurrent sessions allowed.
+	MaxSessions int `yaml:"max-sessions"`
+
+	// BytesPerSecond limits the bytes read from the attackers.
+	BytesPerSecond int64 `yaml:"bytes-per-second"`
+}
+
+// RateLimitConfig contains the limits applied to the connections before
+// they are forwarded.
+type RateLimitConfig struct {
+	// Action is taken when a limit trips: reject, delay or local.
+	Action string `yaml:"action"`
+
+	// MaxDelay is the longest time connections are delayed.
+	MaxDelay time.Duration `yaml:"max-delay"`
+
+	// MaxDelayed is the number of connections delayed at once, further
+	// connections are rejected.
+	MaxDelayed int `yaml:"max-delayed"`
+
+	// MaxLocal is the number of connections served locally at once,
+	// further connections are rejected.
+	MaxLocal int `yaml:"max-local"`
+
+	// IPv4Prefix and IPv6Prefix group sources by network for the source
+	// limits, eg. 24 limits every /24 network as a single source.
+	IPv4Prefix int `yaml:"ipv4-prefix"`
+	IPv6Prefix int `yaml:"ipv6-prefix"`
+
+	// Source is applied to every source, Global to all sessions together.
+	Source RateLimit `yaml:"source"`
+	Global RateLimit `yaml:"global"`
+
+	// Listeners contains the limits of the sessions of specific
+	// listeners, eg. tcp/:8022.
+	Listeners map[string]RateLimit `yaml:"listeners"`
+
+	// Networks contains the limits shared by all sources in a network,
+	// in cidr notation, eg. 192.0.2.0/24.
+	Networks map[string]RateLimit `yaml:"networks"`
+}
+
+// Validate checks the rate limit for negative values.
+func (l RateLimit) Validate() error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return fmt.Errorf("Invalid rate %v with burst %d.", l.Rate, l.Burst)
+	}
+
+	if l.MaxSessions < 0 {
+		return fmt.Errorf("Invalid maximum sessions %d.", l.MaxSessions)
+	}
+
+	if l.BytesPerSecond < 0 {
+		return fmt.Errorf("Invalid bytes per second %d.", l.BytesPerSecond)
+	}
+
+	return nil
+}
+
+// Validate checks the rate limits for invalid values and listeners.
+func (c RateLimitConfig) Validate() error {
+	switch c.Action {
+	case ActionReject, ActionDelay, ActionLocal:
+	default:
+		return fmt.Errorf("Invalid rate limit action %q, expected reject, delay or local.", c.Action)
+	}
+
+	if c.Action == ActionDelay && c.MaxDelay <= 0 {
+		return fmt.Errorf("Invalid maximum delay %s.", c.MaxDelay)
+	}
+
+	if c.Action == ActionDelay && c.MaxDelayed <= 0 {
+		return fmt.Errorf("Invalid maximum delayed connections %d.", c.MaxDelayed)
+	}
+
+	if c.Action == ActionLocal && c.MaxLocal <= 0 {
+		return fmt.Errorf("Invalid maximum local connections %d.", c.MaxLocal)
+	}
+
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("Invalid ipv4 prefix length %d.", c.IPv4Prefix)
+	}
+
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("Invalid ipv6 prefix length %d.", c.IPv6Prefix)
+	}
+
+	if err := c.Source.Validate(); err != nil {
+		return fmt.Errorf("Invalid source rate limit: %s", err.Error())
+	}
+
+	if err := c.Global.Validate(); err != nil {
+		return fmt.Errorf("Invalid global rate limit: %s", err.Error())
+	}
+
+	for port, l := range c.Listeners {
+		if _, err := parseListenAddr(port); err != nil {
+			return fmt.Errorf("Invalid listener %q in rate limits: %s", port, err.Error())
+		}
+
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("Invalid rate limit for listener %q: %s", port, err.Error())
+		}
+	}
+
+	for cidr, l := range c.Networks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("Invalid network %q in rate limits: %s", cidr, err.Error())
+		}
+
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("Invalid rate limit for network %q: %s", cidr, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// bucket is a token bucket, refilled with rate tokens per second up to
+// burst tokens.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst float64, now time.Time) *bucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+}
+
+// wait returns the time until n tokens are available.
+func (b *bucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+
+	if b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes n tokens, the bucket can go into debt.
+func (b *bucket) take(n float64, now time.Time) {
+	b.refill(now)
+	b.tokens -= n
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// usage keeps track of the sessions limited by a RateLimit.
+type usage struct {
+	name  string
+	limit RateLimit
+
+	sessions int
+
+	// conns and bytes are nil when the rate is unlimited.
+	conns *bucket
+	bytes *bucket
+}
+
+func newUsage(name string, l RateLimit, now time.Time) *usage {
+	u := &usage{
+		name:  name,
+		limit: l,
+	}
+
+	if l.Rate > 0 {
+		u.conns = newBucket(l.Rate, float64(l.Burst), now)
+	}
+
+	if l.BytesPerSecond > 0 {
+		u.bytes = newBucket(float64(l.BytesPerSecond), float64(l.BytesPerSecond), now)
+	}
+
+	return u
+}
+
+// check returns the reason a new session isn't allowed and the time after
+// which it may be, or an empty reason if it is allowed.
+func (u *usage) check(now time.Time) (string, time.Duration) {
+	if u.limit.MaxSessions > 0 && u.sessions >= u.limit.MaxSessions {
+		return u.name + "-sessions", sessionRetryInterval
+	}
+
+	if u.conns != nil {
+		if wait := u.conns.wait(1, now); wait > 0 {
+			return u.name + "-rate", wait
+		}
+	}
+
+	return "", 0
+}
+
+func (u *usage) acquire(now time.Time) {
+	u.sessions++
+
+	if u.conns != nil {
+		u.conns.take(1, now)
+	}
+}
+
+// idle returns true if the usage can be forgotten.
+func (u *usage) idle(now time.Time) bool {
+	if u.sessions > 0 {
+		return false
+	}
+
+	if u.conns != nil && !u.conns.full(now) {
+		return false
+	}
+
+	return u.bytes == nil || u.bytes.full(now)
+}
+
+// networkUsage contains the usage shared by the sources in a network.
+type networkUsage struct {
+	network *net.IPNet
+	usage   *usage
+}
+
+// limiter applies the rate limits to new connections.
+type limiter struct {
+	config RateLimitConfig
+
+	m sync.Mutex
+
+	global    *usage
+	listeners map[string]*usage
+	networks  []networkUsage
+	sources   map[string]*usage
+
+	// expireAt is the number of sources after which the idle sources
+	// are expired, when admitting a new source.
+	expireAt int
+}
+
+func newLimiter(c RateLimitConfig) *limiter {
+	now := time.Now()
+
+	l := &limiter{
+		config:    c,
+		global:    newUsage("global", c.Global, now),
+		listeners: map[string]*usage{},
+		sources:   map[string]*usage{},
+		expireAt:  minSourcesExpiry,
+	}
+
+	for port, rl := range c.Listeners {
+		address, err := parseListenAddr(port)
+		if err != nil {
+			continue
+		}
+
+		l.listeners[listenerKey(address)] = newUsage("listener", rl, now)
+	}
+
+	for cidr, rl := range c.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+
+		l.networks = append(l.networks, networkUsage{
+			network: network,
+			usage:   newUsage("network", rl, now),
+		})
+	}
+
+	return l
+}
+
+// sourceKey returns the source raddr is accounted to, the network of
+// raddr when grouping by prefix.
+func (l *limiter) sourceKey(raddr net.Addr) string {
+	ip := hostIP(raddr)
+	if ip == nil {
+		return raddr.String()
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(l.config.IPv4Prefix, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(l.config.IPv6Prefix, 128)).String()
+}
+
+// admit returns the ticket of a new session from raddr, accepted by the
+// listener on address. When a limit trips no ticket is returned, but the
+// limit that tripped and the time after which the session may be allowed.
+func (l *limiter) admit(address net.Addr, raddr net.Addr) (*ticket, string, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+
+	key := l.sourceKey(raddr)
+
+	source, ok := l.sources[key]
+	if !ok {
+		if len(l.sources) >= l.expireAt {
+			l.forget(now)
+
+			l.expireAt = 2 * len(l.sources)
+			if l.expireAt < minSourcesExpiry {
+				l.expireAt = minSourcesExpiry
+			}
+		}
+
+		source = newUsage("source", l.config.Source, now)
+	}
+
+	usages := []*usage{l.global, source}
+	if u, ok := l.listeners[listenerKey(address)]; ok {
+		usages = append(usages, u)
+	}
+
+	if ip := hostIP(raddr); ip != nil {
+		for _, n := range l.networks {
+			if n.network.Contains(ip) {
+				usages = append(usages, n.usage)
+			}
+		}
+	}
+
+	for _, u := range usages {
+		if reason, wait := u.check(now); reason != "" {
+			return nil, reason, wait
+		}
+	}
+
+	l.sources[key] = source
+
+	for _, u := range usages {
+		u.acquire(now)
+	}
+
+	return &ticket{
+		l:      l,
+		usages: usages,
+	}, "", 0
+}
+
+// expire forgets the sources without sessions, whose limits have been
+// restored.
+func (l *limiter) expire() {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.forget(time.Now())
+}
+
+// forget removes the idle sources, the caller must hold l.m.
+func (l *limiter) forget(now time.Time) {
+	for key, u := range l.sources {
+		if u.idle(now) {
+			delete(l.sources, key)
+		}
+	}
+}
+
+// ticket holds the limits of an admitted session, until released.
+type ticket struct {
+	l      *limiter
+	usages []*usage
+
+	once sync.Once
+}
+
+// release returns the session to the limits, when the session closed.
+func (t *ticket) release() {
+	t.once.Do(func() {
+		t.l.m.Lock()
+		defer t.l.m.Unlock()
+
+		for _, u := range t.usages {
+			u.sessions--
+		}
+	})
+}
+
+// throttle accounts n bytes read from the attacker, it returns the time to
+// wait before forwarding them to stay within the bytes per second limits.
+func (t *ticket) throttle(n int) time.Duration {
+	t.l.m.Lock()
+	defer t.l.m.Unlock()
+
+	now := time.Now()
+
+	var wait time.Duration
+	for _, u := range t.usages {
+		if u.bytes == nil {
+			continue
+		}
+
+		u.bytes.take(float64(n), now)
+
+		if u.bytes.tokens < 0 {
+			if d := time.Duration(-u.bytes.tokens / u.bytes.rate * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait
+}
+
+// limited applies the rate limit action to the connection accepted by the
+// listener on address, after reason tripped.
+func (a *Agent) limited(address net.Addr, rw net.Conn, reason string, wait time.Duration) {
+	switch a.config.RateLimits.Action {
+	case ActionLocal:
+		if atomic.AddInt32(&a.servedLocally, 1) > int32(a.config.RateLimits.MaxLocal) {
+			atomic.AddInt32(&a.servedLocally, -1)
+
+			log.Debugf("Rejecting connection from %s, %s limit, too many local connections", rw.RemoteAddr(), reason)
+
+			a.reports.count("rate-limit", reason, ActionReject, rw.RemoteAddr())
+			reject(rw)
+			return
+		}
+
+		a.reports.count("rate-limit", reason, ActionLocal, rw.RemoteAddr())
+
+		a.session(func() {
+			defer atomic.AddInt32(&a.servedLocally, -1)
+
+			a.serveLocal(rw, a.limits(address))
+		})
+	case ActionDelay:
+		if atomic.AddInt32(&a.delayed, 1) > int32(a.config.RateLimits.MaxDelayed) {
+			atomic.AddInt32(&a.delayed, -1)
+
+			log.Debugf("Rejecting connection from %s, %s limit, too many delayed connections", rw.RemoteAddr(), reason)
+
+			a.reports.count("rate-limit", reason, ActionReject, rw.RemoteAddr())
+			reject(rw)
+			return
+		}
+
+		a.session(func() {
+			defer atomic.AddInt32(&a.delayed, -1)
+
+			a.delay(address, rw, reason, wait)
+		})
+	default:
+		log.Debugf("Rejecting connection from %s, %s limit", rw.RemoteAddr(), reason)
+
+		a.reports.count("rate-limit", reason, ActionReject, rw.RemoteAddr())
+		reject(rw)
+	}
+}
+
+// delay forwards the connection once the limits allow it, it is rejected
+// if that takes longer than the maximum delay.
+func (a *Agent) delay(address net.Addr, rw net.Conn, reason string, wait time.Duration) {
+	deadline := time.Now().Add(a.config.RateLimits.MaxDelay)
+
+	for {
+		if time.Now().Add(wait).After(deadline) {
+			log.Debugf("Rejecting connection from %s, %s limit", rw.RemoteAddr(), reason)
+
+			a.reports.count("rate-limit", reason, ActionReject, rw.RemoteAddr())
+			reject(rw)
+			return
+		}
+
+		time.Sleep(wait)
+
+		if atomic.LoadInt32(&a.stopping) == 1 {
+			rw.Close()
+			return
+		}
+
+		t, r, w := a.limiter.admit(address, rw.RemoteAddr())
+		if t != nil {
+			a.reports.count("rate-limit", reason, ActionDelay, rw.RemoteAddr())
+			a.forward(address, rw, t)
+			return
+		}
+
+		reason, wait = r, w
+	}
+}
+
+// throttle delays forwarding n bytes read from the attacker to stay within
+// the bytes per second limits, it returns false if the connection has been
+// closed meanwhile.
+func (c *conn) throttle(n int) bool {
+	if c.ticket == nil {
+		return true
+	}
+
+	wait := c.ticket.throttle(n)
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
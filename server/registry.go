@@ -0,0 +1,242 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	// EventOpened is emitted when a session has been added.
+	EventOpened EventType = iota
+	// EventClosed is emitted when a session has been closed.
+	EventClosed
+	// EventRead is emitted when data has been read from the attacker.
+	EventRead
+	// EventWritten is emitted when data has been written to the attacker.
+	EventWritten
+	// EventUpstream is emitted when the state of the connection with a
+	// server changes.
+	EventUpstream
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventOpened:
+		return "opened"
+	case EventClosed:
+		return "closed"
+	case EventRead:
+		return "read"
+	case EventWritten:
+		return "written"
+	case EventUpstream:
+		return "upstream"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change of a session in the registry.
+type Event struct {
+	Type EventType
+
+	ID    uint32
+	Laddr net.Addr
+	Raddr net.Addr
+
+	// Bytes contains the number of bytes read or written.
+	Bytes int
+
+	// Reason contains the close reason for EventClosed.
+	Reason int
+
+	// Server and State contain the address of the server and the new
+	// state of its connection for EventUpstream.
+	Server string
+	State  State
+
+	// Delay contains the time until reconnecting in StateBackingOff.
+	Delay time.Duration
+
+	// Error describes why the connection failed, if it did.
+	Error string
+}
+
+// eventQueueSize is the number of events buffered for each subscriber.
+const eventQueueSize = 1024
+
+// Registry contains the sessions, indexed by stream id and by address for
+// servers using the legacy protocol. Changes to the sessions are published
+// as events to the subscribers.
+type Registry struct {
+	m sync.RWMutex
+
+	ids   map[uint32]*conn
+	addrs map[string]*conn
+
+	subscribers []chan Event
+}
+
+func connKey(laddr net.Addr, raddr net.Addr) string {
+	return laddr.Network() + "/" + laddr.String() + "/" + raddr.String()
+}
+
+func (r *Registry) Add(c *conn) {
+	r.m.Lock()
+
+	if r.ids == nil {
+		r.ids = map[uint32]*conn{}
+		r.addrs = map[string]*conn{}
+	}
+
+	r.ids[c.id] = c
+	r.addrs[connKey(c.LocalAddr(), c.RemoteAddr())] = c
+
+	r.m.Unlock()
+
+	r.emit(Event{
+		Type:  EventOpened,
+		ID:    c.id,
+		Laddr: c.LocalAddr(),
+		Raddr: c.RemoteAddr(),
+	})
+}
+
+// Remove removes the session from the registry, it returns false if the
+// session wasn't registered.
+func (r *Registry) Remove(c *conn, reason int) bool {
+	r.m.Lock()
+
+	if v, ok := r.ids[c.id]; !ok || v != c {
+		r.m.Unlock()
+		return false
+	}
+
+	delete(r.ids, c.id)
+
+	key := connKey(c.LocalAddr(), c.RemoteAddr())
+	if v, ok := r.addrs[key]; ok && v == c {
+		delete(r.addrs, key)
+	}
+
+	r.m.Unlock()
+
+	r.emit(Event{
+		Type:   EventClosed,
+		ID:     c.id,
+		Laddr:  c.LocalAddr(),
+		Raddr:  c.RemoteAddr(),
+		Reason: reason,
+	})
+
+	return true
+}
+
+// Get returns the session with stream id, or with laddr and raddr if id is
+// zero.
+func (r *Registry) Get(id uint32, laddr net.Addr, raddr net.Addr) *conn {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if id != 0 {
+		return r.ids[id]
+	}
+
+	if laddr == nil || raddr == nil {
+		return nil
+	}
+
+	return r.addrs[connKey(laddr, raddr)]
+}
+
+// All returns a snapshot of the registered sessions.
+func (r *Registry) All() []*conn {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	conns := make([]*conn, 0, len(r.ids))
+	for _, c := range r.ids {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+func (r *Registry) Len() int {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return len(r.ids)
+}
+
+// Subscribe returns a channel receiving the events of the registry. Events
+// will be dropped if the subscriber doesn't keep up.
+func (r *Registry) Subscribe() <-chan Event {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	ch := make(chan Event, eventQueueSize)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe removes the subscription and closes its channel.
+func (r *Registry) Unsubscribe(ch <-chan Event) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for i, v := range r.subscribers {
+		if v != ch {
+			continue
+		}
+
+		r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+		close(v)
+		return
+	}
+}
+
+func (r *Registry) emit(e Event) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	for _, ch := range r.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,631 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+
+	logging "github.com/op/go-logging"
+)
+
+// upstream is a connection with a server.
+type upstream struct {
+	id uint32
+
+	in chan encoding.BinaryMarshaler
+
+	// supervisor runs the goroutines of the connection, they are stopped
+	// when the connection has been lost.
+	supervisor *supervisor
+}
+
+// send queues o to be sent to the server, it returns false if the
+// connection has been lost.
+func (u *upstream) send(o encoding.BinaryMarshaler) bool {
+	select {
+	case u.in <- o:
+		return true
+	case <-u.supervisor.Done():
+		return false
+	}
+}
+
+// remote is a Honeytrap server the agent connects to, the sessions
+// forwarded to the server are bound to it.
+type remote struct {
+	agent *Agent
+
+	// address is the address of the server.
+	address string
+
+	transport Transport
+
+	// capabilities contains the features negotiated with the server.
+	capabilities uint32
+
+	// maxPayload contains the largest payload that fits a frame accepted
+	// by the server.
+	maxPayload int32
+
+	heartbeat Heartbeat
+
+	// state contains the State of the connection with the server.
+	state int32
+
+	backoff *backoff
+
+	// m guards upstream and suspended.
+	m sync.Mutex
+
+	// upstream is the current connection with the server, nil while the
+	// server is unreachable.
+	upstream *upstream
+
+	// suspended contains the sessions closed while the server was
+	// unreachable, they will be replayed when resuming.
+	suspended []*conn
+
+	// sm serializes the suspension and resumption of the sessions, and
+	// guards suspension and suspendedFrom.
+	sm            sync.Mutex
+	suspension    *time.Timer
+	suspendedFrom uint32
+
+	// active is true while the server is connected or its sessions are
+	// suspended, guarded by the lm mutex of the agent.
+	active bool
+}
+
+func newRemote(a *Agent, s ServerConfig) (*remote, error) {
+	transport := a.transport
+	if transport == nil {
+		var err error
+		if transport, err = newTransport(a.config, s); err != nil {
+			return nil, fmt.Errorf("Error configuring transport for %s: %s", s.Host, err.Error())
+		}
+	}
+
+	return &remote{
+		agent:     a,
+		address:   serverAddress(s.Host),
+		transport: transport,
+		backoff:   newBackoff(a.config.ReconnectDelay, a.config.MaxReconnectDelay),
+	}, nil
+}
+
+func (r *remote) String() string {
+	return r.address
+}
+
+func (r *remote) newUpstream(s *supervisor) *upstream {
+	return &upstream{
+		id:         atomic.AddUint32(&r.agent.lastUpstream, 1),
+		in:         make(chan encoding.BinaryMarshaler, 128),
+		supervisor: s,
+	}
+}
+
+// current returns the current connection with the server, or nil if the
+// server is unreachable.
+func (r *remote) current() *upstream {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.upstream
+}
+
+// connected returns true if there is a connection with the server.
+func (r *remote) connected() bool {
+	return r.current() != nil
+}
+
+// suspending returns true if the sessions of the server are kept open
+// while waiting for the server to return.
+func (r *remote) suspending() bool {
+	r.sm.Lock()
+	defer r.sm.Unlock()
+
+	return r.suspension != nil
+}
+
+// send sends o to the server, it returns false if the server is
+// unreachable.
+func (r *remote) send(o encoding.BinaryMarshaler) bool {
+	u := r.current()
+	if u == nil {
+		return false
+	}
+
+	return u.send(o)
+}
+
+// supports returns true if the feature has been negotiated with the
+// server.
+func (r *remote) supports(c Capabilities) bool {
+	return Capabilities(atomic.LoadUint32(&r.capabilities)).Has(c)
+}
+
+func (r *remote) maxPayloadSize() int {
+	return int(atomic.LoadInt32(&r.maxPayload))
+}
+
+// offered returns the capabilities offered to the server.
+func (r *remote) offered() Capabilities {
+	caps := AgentCapabilities
+	if r.agent.config.ResumeBuffer == 0 {
+		caps &^= CapabilityResume
+	}
+
+	return caps
+}
+
+// ping returns the next ping for the server, or false if the server hasn't
+// answered the last pings.
+func (r *remote) ping() (Ping, bool) {
+	if !r.supports(CapabilityHeartbeat) {
+		// keep alive only
+		return Ping{}, true
+	}
+
+	if missed := r.heartbeat.Missed(); missed >= r.agent.config.MaxMissedPongs {
+		return Ping{}, false
+	}
+
+	return r.heartbeat.Ping(time.Now()), true
+}
+
+// session returns the session forwarded to the server with stream id, or
+// with laddr and raddr if id is zero.
+func (r *remote) session(id uint32, laddr net.Addr, raddr net.Addr) *conn {
+	c := r.agent.conns.Get(id, laddr, raddr)
+	if c == nil || c.remote != r {
+		return nil
+	}
+
+	return c
+}
+
+// handle handles a message received from the server.
+func (r *remote) handle(o interface{}) {
+	a := r.agent
+
+	switch v := o.(type) {
+	case *ReadWrite:
+		conn := r.session(v.ID, v.Laddr, v.Raddr)
+		if conn == nil {
+			break
+		}
+
+		conn.enqueue(v.Payload)
+	case *EOF:
+		conn := r.session(v.ID, v.Laddr, v.Raddr)
+		if conn == nil {
+			break
+		}
+
+		conn.eof(v.Reason)
+	case *Window:
+		conn := r.session(v.ID, nil, nil)
+		if conn == nil {
+			break
+		}
+
+		conn.grant(v.Credit)
+	case *Ack:
+		conn := r.session(v.ID, nil, nil)
+		if conn == nil {
+			break
+		}
+
+		conn.ack(v.Offset)
+	case *ListenerUpdate:
+		r.send(a.updateListeners(v))
+	case *Ping:
+		if v.Seq == 0 {
+			break
+		}
+
+		r.send(Pong{
+			Seq:       v.Seq,
+			Timestamp: v.Timestamp,
+		})
+	case *Pong:
+		rtt := r.heartbeat.Pong(v, time.Now())
+		log.Debugf("Received pong %d from %s, rtt: %s", v.Seq, r, rtt)
+	default:
+		log.Warningf("Unexpected message from %s: %T", r, o)
+	}
+}
+
+// flush is queued to find out when the messages queued before it have been
+// sent, the writer closes it instead of sending it.
+type flush chan struct{}
+
+func (f flush) MarshalBinary() ([]byte, error) {
+	return nil, errors.New("Flush can't be sent.")
+}
+
+// disconnect is returned by connect when the server closed the connection
+// using Error or Control.
+type disconnect struct {
+	reason string
+
+	// retryAfter overrides the delay before reconnecting when set.
+	retryAfter time.Duration
+
+	// permanent stops reconnecting to the server.
+	permanent bool
+}
+
+func (d *disconnect) Error() string {
+	return d.reason
+}
+
+// rejected returns the disconnect for the error received from the server.
+func (r *remote) rejected(v *Error) *disconnect {
+	d := &disconnect{
+		reason:     fmt.Sprintf("Server %s rejected the agent: %s", r, v),
+		retryAfter: time.Duration(v.RetryAfter) * time.Second,
+	}
+
+	if v.Message != "" {
+		d.reason += ": " + v.Message
+	}
+
+	switch v.Code {
+	case ErrorInvalidToken, ErrorUnsupportedVersion:
+		d.permanent = true
+	}
+
+	return d
+}
+
+// control handles the commands received from the server, it returns a
+// disconnect when the server asks the agent to go away.
+func (r *remote) control(v *Control) *disconnect {
+	switch v.Command {
+	case ControlGoAway:
+		reason := fmt.Sprintf("Server %s is going away", r)
+		if v.Value != "" {
+			reason += ": " + v.Value
+		}
+
+		return &disconnect{
+			reason:     reason,
+			retryAfter: time.Duration(v.RetryAfter) * time.Second,
+		}
+	case ControlLogLevel:
+		level, err := logging.LogLevel(v.Value)
+		if err != nil {
+			log.Warningf("Server %s set invalid log level %q", r, v.Value)
+			break
+		}
+
+		logging.SetLevel(level, "")
+		log.Infof("Server %s set log level to %s", r, level)
+	default:
+		log.Warningf("Unknown control command from %s: %d", r, v.Command)
+	}
+
+	return nil
+}
+
+// setState changes the state of the connection with the server, the change
+// is logged and emitted as event. Delay is the time until reconnecting and
+// err the reason of the failure, if any.
+func (r *remote) setState(s State, delay time.Duration, err error) {
+	atomic.StoreInt32(&r.state, int32(s))
+
+	e := Event{
+		Type:   EventUpstream,
+		Server: r.address,
+		State:  s,
+		Delay:  delay,
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	switch {
+	case s == StateConnecting:
+		log.Infof("Connecting to Honeytrap %s...", r)
+	case s == StateHandshaking:
+		log.Debugf("Connected to Honeytrap %s, handshaking.", r)
+	case s == StateConnected:
+		log.Infof("Connected to Honeytrap %s.", r)
+	case s == StateStopped && err == nil:
+		log.Infof("Stopped connecting to Honeytrap %s.", r)
+	case s == StateStopped:
+		log.Errorf("%s, not reconnecting.", e.Error)
+	case err != nil:
+		log.Errorf("%s, reconnecting in %s.", e.Error, delay)
+	default:
+		log.Infof("Honeytrap %s disconnected, reconnecting in %s.", r, delay)
+	}
+
+	r.agent.conns.emit(e)
+}
+
+// State returns the state of the connection with the server.
+func (r *remote) State() State {
+	return State(atomic.LoadInt32(&r.state))
+}
+
+// run keeps connecting to the server, backing off exponentially while the
+// server is unreachable, until ctx is done or the server rejects the agent
+// permanently.
+func (r *remote) run(ctx context.Context) {
+	for {
+		err := r.connect(ctx)
+		if ctx.Err() != nil {
+			r.setState(StateStopped, 0, nil)
+			return
+		}
+
+		d, ok := err.(*disconnect)
+		if ok && d.permanent {
+			r.setState(StateStopped, 0, err)
+			return
+		}
+
+		delay := r.backoff.next()
+		if ok && d.retryAfter > 0 {
+			delay = d.retryAfter
+		}
+
+		r.setState(StateBackingOff, delay, err)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			r.setState(StateStopped, 0, nil)
+			return
+		}
+	}
+}
+
+// connect connects to the server, and forwards the sessions until the
+// connection has been lost or ctx is done. All goroutines of the connection
+// have returned when connect returns.
+func (r *remote) connect(ctx context.Context) error {
+	a := r.agent
+
+	r.setState(StateConnecting, 0, nil)
+
+	hctx, cancel := context.WithTimeout(ctx, a.config.HandshakeTimeout)
+	defer cancel()
+
+	conn, err := r.transport.Dial(hctx, r.address)
+	if err != nil {
+		return fmt.Errorf("Error connecting to server: %s: %s", r.address, err.Error())
+	}
+
+	// the handshake of the protocol should complete within the same
+	// deadline
+	deadline, _ := hctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	cc := newAgentConnection(conn)
+
+	s := newSupervisor(ctx)
+	defer s.Stop()
+
+	s.Go(func(ctx context.Context) {
+		<-ctx.Done()
+
+		// unblocks the receive loop and the writer
+		cc.Close()
+	})
+
+	r.setState(StateHandshaking, 0, nil)
+
+	atomic.StoreUint32(&r.capabilities, 0)
+	atomic.StoreInt32(&r.maxPayload, LegacyMaxFrameSize-frameOverhead)
+
+	r.heartbeat.Reset()
+
+	hs := Handshake{
+		Version:      ProtocolVersion,
+		MaxFrameSize: uint32(a.config.MaxFrameSize),
+		Capabilities: r.offered(),
+	}
+
+	hs.describe(a.config.Labels)
+
+	if err := cc.send(hs); err != nil {
+		return fmt.Errorf("Error sending handshake to %s: %s", r, err.Error())
+	}
+
+	o, err := cc.receive()
+	if err != nil {
+		return fmt.Errorf("Invalid handshake response from %s: %s", r, err.Error())
+	}
+
+	if v, ok := o.(*Error); ok {
+		return r.rejected(v)
+	}
+
+	hr, ok := o.(*HandshakeResponse)
+	if !ok {
+		return fmt.Errorf("Invalid handshake response from %s: %T", r, o)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	version, caps := negotiate(hr)
+	caps &= r.offered()
+
+	log.Infof("Using protocol version %d with %s, capabilities: %s", version, r, caps)
+
+	cc.negotiate(caps, a.config.MaxFrameSize, int(hr.MaxFrameSize))
+
+	atomic.StoreUint32(&r.capabilities, uint32(caps))
+	atomic.StoreInt32(&r.maxPayload, int32(cc.peerMaxFrameSize-frameOverhead))
+
+	r.backoff.reset()
+	r.setState(StateConnected, 0, nil)
+
+	u := r.newUpstream(s)
+
+	resume := r.attach(u, caps.Has(CapabilityResume))
+	defer r.detach(u, caps.Has(CapabilityResume))
+
+	// a write taking as long as the server may miss pongs means the
+	// connection is dead as well
+	cc.writeTimeout = a.config.HeartbeatInterval * time.Duration(a.config.MaxMissedPongs)
+
+	// send sends o to the server, the connection is closed if writing
+	// fails
+	send := func(o encoding.BinaryMarshaler) {
+		err := cc.send(o)
+		if err == nil {
+			return
+		}
+
+		if _, ok := err.(FrameSizeError); ok || err == ErrDataTooLarge {
+			log.Errorf("Error sending %T to server %s: %s", o, r, err.Error())
+			return
+		}
+
+		select {
+		case <-s.Done():
+			// the connection has been closed already
+		default:
+			log.Errorf("Error sending to server %s, reconnecting: %s", r, err.Error())
+			s.Cancel()
+		}
+	}
+
+	// the heartbeat runs independently of the writer, so a stalled write
+	// doesn't hide a dead server
+	s.Go(func(ctx context.Context) {
+		ticker := time.NewTicker(a.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			ping, ok := r.ping()
+			if !ok {
+				log.Errorf("Server %s didn't answer %d pings, reconnecting.", r, a.config.MaxMissedPongs)
+
+				s.Cancel()
+				return
+			}
+
+			send(ping)
+		}
+	})
+
+	s.Go(func(ctx context.Context) {
+		for {
+			select {
+			case data := <-u.in:
+				if f, ok := data.(flush); ok {
+					close(f)
+					continue
+				}
+
+				send(data)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	if resume {
+		r.resume(u)
+	}
+
+	addresses := []net.Addr{}
+	for _, address := range a.ports {
+		if _, ok := address.(*net.UDPAddr); ok && !caps.Has(CapabilityUDP) {
+			log.Warningf("Server %s doesn't support udp, skipping listener %s", r, address)
+			continue
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	addresses = append(addresses, hr.Addresses...)
+
+	if atomic.LoadInt32(&a.stopping) == 1 {
+		addresses = nil
+	}
+
+	// we know what ports to listen to
+	for _, address := range addresses {
+		if err := a.addListener(address); err != nil {
+			fmt.Println(color.RedString("Error starting listener: %s", err.Error()))
+		}
+	}
+
+	for {
+		o, err := cc.receive()
+		if err == io.EOF {
+			return nil
+		} else if _, ok := err.(UnknownTypeError); ok {
+			log.Warningf("Ignoring frame: %s", err.Error())
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error receiving from server %s: %s", r, err.Error())
+		}
+
+		switch v := o.(type) {
+		case *Error:
+			return r.rejected(v)
+		case *Control:
+			if d := r.control(v); d != nil {
+				return d
+			}
+		default:
+			r.handle(o)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flappingTransport connects to an in memory server that completes the
+// handshake and closes the connection right after.
+type flappingTransport struct {
+	dials chan struct{}
+}
+
+func (t *flappingTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		sc := newAgentConnection(server)
+		if _, err := sc.receive(); err != nil {
+			return
+		}
+
+		sc.send(HandshakeResponse{
+			Version:      ProtocolVersion,
+			MaxFrameSize: LegacyMaxFrameSize,
+			Capabilities: AgentCapabilities,
+		})
+	}()
+
+	select {
+	case t.dials <- struct{}{}:
+	default:
+	}
+
+	return client, nil
+}
+
+// TestReconnectGoroutines checks that no goroutines are leaked by
+// connecting and disconnecting repeatedly.
+func TestReconnectGoroutines(t *testing.T) {
+	const reconnects = 20
+
+	dir, err := ioutil.TempDir("", "honeytrap-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	baseline := runtime.NumGoroutine()
+
+	transport := &flappingTransport{
+		dials: make(chan struct{}),
+	}
+
+	a, err := New(
+		WithServer("127.0.0.1:1337"),
+		WithKey(strings.Repeat("00", 32)),
+		WithToken(filepath.Join(dir, "token")),
+		WithTransport(transport),
+		WithLogLevel("error"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.remotes[0].backoff = newBackoff(time.Millisecond, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	for i := 0; i < reconnects; i++ {
+		select {
+		case <-transport.dials:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Agent reconnected %d times, expected %d.", i, reconnects)
+		}
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return.")
+	}
+
+	// goroutines take a moment to exit after being unblocked
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > baseline {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+
+		t.Fatalf("Expected %d goroutines after %d reconnects, got %d:\n%s", baseline, reconnects, n, buf)
+	}
+}
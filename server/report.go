@@ -0,0 +1,188 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxReportSources is the number of sources sent in a report.
+const maxReportSources = 16
+
+// maxTrackedSources is the number of sources counted during a report
+// interval.
+const maxTrackedSources = 1024
+
+type reportKey struct {
+	stage  string
+	reason string
+	action string
+}
+
+// reporter counts the connections handled by the agent itself, they are
+// reported to the server periodically.
+type reporter struct {
+	m sync.Mutex
+
+	since    time.Time
+	counters map[reportKey]uint64
+	sources  map[string]uint64
+}
+
+func newReporter() *reporter {
+	return &reporter{
+		since:    time.Now(),
+		counters: map[reportKey]uint64{},
+		sources:  map[string]uint64{},
+	}
+}
+
+// count counts a connection from raddr, handled by stage for reason.
+func (r *reporter) count(stage, reason, action string, raddr net.Addr) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.counters[reportKey{stage, reason, action}]++
+
+	ip := hostIP(raddr)
+	if ip == nil {
+		return
+	}
+
+	key := ip.String()
+	if _, ok := r.sources[key]; ok || len(r.sources) < maxTrackedSources {
+		r.sources[key]++
+		return
+	}
+
+	// replace the least active source, the new source takes over its
+	// count. This keeps the most active sources, at the cost of
+	// overcounting the sources that were seen late.
+	least := ""
+	for k, n := range r.sources {
+		if least == "" || n < r.sources[least] {
+			least = k
+		}
+	}
+
+	n := r.sources[least]
+	delete(r.sources, least)
+
+	r.sources[key] = n + 1
+}
+
+// take returns the report of the connections counted since the previous
+// report, or false if there are none.
+func (r *reporter) take(now time.Time) (Report, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	report := Report{
+		Period:   uint32(now.Sub(r.since) / time.Second),
+		Counters: []ReportCounter{},
+		Sources:  []ReportSource{},
+	}
+
+	r.since = now
+
+	if len(r.counters) == 0 {
+		return report, false
+	}
+
+	for k, n := range r.counters {
+		report.Counters = append(report.Counters, ReportCounter{
+			Stage:  k.stage,
+			Reason: k.reason,
+			Action: k.action,
+			Count:  n,
+		})
+	}
+
+	sort.Slice(report.Counters, func(i, j int) bool {
+		return report.Counters[i].Count > report.Counters[j].Count
+	})
+
+	for ip, n := range r.sources {
+		report.Sources = append(report.Sources, ReportSource{
+			IP:    net.ParseIP(ip),
+			Count: n,
+		})
+	}
+
+	sort.Slice(report.Sources, func(i, j int) bool {
+		return report.Sources[i].Count > report.Sources[j].Count
+	})
+
+	if len(report.Sources) > maxReportSources {
+		report.Sources = report.Sources[:maxReportSources]
+	}
+
+	r.counters = map[reportKey]uint64{}
+	r.sources = map[string]uint64{}
+
+	return report, true
+}
+
+// reportLoop reports the connections handled by the agent itself to the
+// first connected server supporting reports, every report interval.
+func (a *Agent) reportLoop(ctx context.Context) {
+	ticker := time.NewTicker(a.config.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		a.limiter.expire()
+
+		report, ok := a.reports.take(time.Now())
+		if !ok {
+			continue
+		}
+
+		for _, c := range report.Counters {
+			log.Warningf("%d connections not forwarded, %s %s: %s", c.Count, c.Stage, c.Reason, c.Action)
+		}
+
+		for _, r := range a.remotes {
+			if r.connected() && r.supports(CapabilityReports) && r.send(report) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"time"
+)
+
+// sendBuffer contains the data sent to the server that hasn't been
+// acknowledged yet.
+type sendBuffer struct {
+	// offset is the stream offset of the first byte of data.
+	offset uint64
+	data   []byte
+}
+
+func (b *sendBuffer) Write(p []byte) {
+	b.data = append(b.data, p...)
+}
+
+// Ack discards the data before offset.
+func (b *sendBuffer) Ack(offset uint64) {
+	if offset <= b.offset {
+		return
+	}
+
+	n := offset - b.offset
+	if n > uint64(len(b.data)) {
+		n = uint64(len(b.data))
+	}
+
+	b.data = append([]byte{}, b.data[n:]...)
+	b.offset += n
+}
+
+func (b *sendBuffer) Len() int {
+	return len(b.data)
+}
+
+// Offset returns the stream offset of the first unacknowledged byte.
+func (b *sendBuffer) Offset() uint64 {
+	return b.offset
+}
+
+func (b *sendBuffer) Bytes() []byte {
+	return b.data
+}
+
+// attach makes u the current server connection. Suspended sessions will
+// be reset if the server doesn't support resumption, it returns true if
+// they should be resumed.
+func (r *remote) attach(u *upstream, resume bool) bool {
+	r.sm.Lock()
+	defer r.sm.Unlock()
+
+	suspended := r.suspension != nil
+	if suspended {
+		r.suspension.Stop()
+		r.suspension = nil
+	}
+
+	if suspended && !resume {
+		log.Warningf("Server %s doesn't support resumption, closing suspended sessions.", r)
+		r.reset()
+	}
+
+	r.agent.setActive(r, true)
+
+	r.m.Lock()
+	r.upstream = u
+	r.m.Unlock()
+
+	return suspended && resume
+}
+
+// detach is called when the connection with the server has been lost. The
+// sessions are kept open for the resume timeout if the server supports
+// resumption, otherwise they will be closed.
+func (r *remote) detach(u *upstream, resume bool) {
+	r.sm.Lock()
+	defer r.sm.Unlock()
+
+	r.m.Lock()
+	r.upstream = nil
+	r.m.Unlock()
+
+	u.supervisor.Cancel()
+
+	if !resume {
+		// the sessions can't be forwarded anymore
+		r.reset()
+		r.agent.setActive(r, false)
+		return
+	}
+
+	log.Infof("Suspending the sessions of %s for %s.", r, r.agent.config.ResumeTimeout)
+
+	r.suspension = time.AfterFunc(r.agent.config.ResumeTimeout, func() {
+		r.expire(u.id)
+	})
+	r.suspendedFrom = u.id
+}
+
+// expire closes the suspended sessions when the server didn't return
+// within the resume timeout.
+func (r *remote) expire(id uint32) {
+	r.sm.Lock()
+	defer r.sm.Unlock()
+
+	if r.suspension == nil || r.suspendedFrom != id {
+		return
+	}
+
+	r.suspension = nil
+
+	log.Warningf("Server %s didn't return within %s, closing suspended sessions.", r, r.agent.config.ResumeTimeout)
+
+	r.reset()
+	r.agent.setActive(r, false)
+}
+
+// sessions returns the open sessions forwarded to the server.
+func (r *remote) sessions() []*conn {
+	conns := []*conn{}
+
+	for _, c := range r.agent.conns.All() {
+		if c.remote == r {
+			conns = append(conns, c)
+		}
+	}
+
+	return conns
+}
+
+// reset closes the sessions of the server.
+func (r *remote) reset() {
+	r.m.Lock()
+	r.suspended = nil
+	r.m.Unlock()
+
+	for _, c := range r.sessions() {
+		c.close(EOFReasonRST)
+	}
+}
+
+// suspend keeps a session that has been closed while the server was
+// unreachable, its data and close reason will be replayed on resume.
+func (r *remote) suspend(c *conn) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.suspended = append(r.suspended, c)
+}
+
+// resume re-announces the open sessions, and the sessions closed while the
+// server was unreachable, to the server.
+func (r *remote) resume(u *upstream) {
+	conns := r.sessions()
+
+	r.m.Lock()
+	conns = append(conns, r.suspended...)
+	r.suspended = nil
+	r.m.Unlock()
+
+	log.Infof("Resuming %d sessions with %s.", len(conns), r)
+
+	for _, c := range conns {
+		c.resume(u)
+	}
+}
+
+// resumable returns true if the data of the session should be kept until
+// acknowledged, which is the case while the server is unreachable or when
+// it supports resumption.
+func (c *conn) resumable() bool {
+	if c.agent.config.ResumeBuffer == 0 {
+		return false
+	}
+
+	return !c.remote.connected() || c.remote.supports(CapabilityResume)
+}
+
+// ack discards the data acknowledged by the server.
+func (c *conn) ack(offset uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.sent.Ack(offset)
+	c.cond.Broadcast()
+}
+
+// resume announces the session on u, replaying the unacknowledged data.
+func (c *conn) resume(u *upstream) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.upstream == u.id {
+		return
+	}
+
+	announced := c.upstream != 0
+
+	c.upstream = u.id
+
+	if announced {
+		c.forward(Resume{
+			ID:       c.id,
+			Laddr:    c.LocalAddr(),
+			Raddr:    c.RemoteAddr(),
+			Offset:   c.sent.Offset(),
+			Received: c.received,
+		})
+	} else {
+		c.forward(c.hello())
+	}
+
+	c.forwardData(c.sent.Bytes())
+
+	if c.closed {
+		c.forward(c.eofMessage(c.reason))
+	} else if c.readClosed {
+		c.forward(c.eofMessage(EOFReasonHalfClose))
+	}
+
+	c.credit = InitialWindow
+	c.cond.Broadcast()
+}
@@ -32,56 +32,76 @@ package server
 
 import (
 	"context"
-	"encoding"
 	"fmt"
-	"io"
+	"hash/fnv"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatih/color"
-	"github.com/mimoo/disco/libdisco"
 
 	logging "github.com/op/go-logging"
 )
 
 var log = logging.MustGetLogger("agent")
 
-type Config struct {
-}
+type Agent struct {
+	config Config
 
-type Connections []*conn
+	conns Registry
 
-func (c Connections) Get(laddr net.Addr, raddr net.Addr) *conn {
-	for _, conn := range c {
-		if conn.LocalAddr().String() != laddr.String() {
-			continue
-		}
+	token string
 
-		if conn.RemoteAddr().String() != raddr.String() {
-			continue
-		}
+	// lastID contains the last allocated stream id.
+	lastID uint32
 
-		return conn
-	}
+	// lastUpstream contains the id of the last server connection.
+	lastUpstream uint32
 
-	return nil
-}
+	// ports contains the addresses that will be listened on besides the
+	// ones received from the server.
+	ports []net.Addr
 
-type Agent struct {
-	config *Config
+	listeners Listeners
 
-	in chan encoding.BinaryMarshaler
+	// remotes contains the servers in order of preference.
+	remotes []*remote
 
-	conns Connections
+	// transport overrides the transport configured for the servers.
+	transport Transport
 
-	token string
+	// lm serializes closing the listeners with servers becoming active.
+	lm sync.Mutex
+
+	// sessions counts the sessions being served, open contains their
+	// number.
+	sessions sync.WaitGroup
+	open     int32
+
+	// stopping is set when the agent is shutting down, no listeners will
+	// be started anymore.
+	stopping int32
+
+	filter  *filter
+	limiter *limiter
+
+	// delayed and servedLocally count the connections delayed and served
+	// locally by the rate limits.
+	delayed       int32
+	servedLocally int32
+
+	// reports counts the connections that haven't been forwarded.
+	reports *reporter
 
-	Server    string
-	RemoteKey []byte
+	// local contains the connections served locally.
+	local localSessions
 }
 
 func New(options ...OptionFn) (*Agent, error) {
-	h := &Agent{}
+	h := &Agent{
+		config: DefaultConfig(),
+	}
 
 	for _, fn := range options {
 		if err := fn(h); err != nil {
@@ -89,185 +109,359 @@ func New(options ...OptionFn) (*Agent, error) {
 		}
 	}
 
+	if err := h.config.Validate(); err != nil {
+		return nil, err
+	}
+
+	level, _ := logging.LogLevel(h.config.LogLevel)
+	logging.SetLevel(level, "")
+
+	for _, s := range h.config.servers() {
+		r, err := newRemote(h, s)
+		if err != nil {
+			return nil, err
+		}
+
+		h.remotes = append(h.remotes, r)
+	}
+
+	for _, port := range h.config.Ports {
+		address, _ := parseListenAddr(port)
+		h.ports = append(h.ports, address)
+	}
+
+	token, err := loadToken(h.config.Token)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading token: %s", err.Error())
+	}
+
+	h.token = token
+
+	f, err := newFilter(h.config.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	h.filter = f
+	h.limiter = newLimiter(h.config.RateLimits)
+	h.reports = newReporter()
+
 	return h, nil
 }
 
-func (a *Agent) newConn(rw net.Conn) (c *conn, err error) {
+func (a *Agent) newConn(rw net.Conn, r *remote, limits Limits, t *ticket) (c *conn, err error) {
 	c = &conn{
-		Conn:  rw,
-		host:  "",
-		agent: a,
-		out:   make(chan []byte),
+		Conn:      rw,
+		limits:    limits,
+		ticket:    t,
+		host:      "",
+		agent:     a,
+		remote:    r,
+		id:        atomic.AddUint32(&a.lastID, 1),
+		out:       make(chan []byte, a.config.QueueSize),
+		done:      make(chan struct{}),
+		halfClose: make(chan struct{}),
+		more:      make(chan struct{}, 1),
+		credit:    InitialWindow,
 	}
 
-	a.conns = append(a.conns, c)
+	c.cond = sync.NewCond(&c.m)
+
+	a.conns.Add(c)
 
 	return c, nil
 }
 
-func (a *Agent) serv(l net.Listener) error {
+// maxAcceptDelay is the longest time to wait before accepting again, after
+// a temporary error.
+const maxAcceptDelay = time.Second
+
+func (a *Agent) serv(address net.Addr, l net.Listener) error {
 	defer l.Close()
 
+	// delay is the time to wait after a temporary error, eg. running out
+	// of file descriptors during a flood
+	var delay time.Duration
+
 	for {
-		// TODO: Actually, should only accept if client connection has been built.
 		rw, err := l.Accept()
-		if err != nil {
-			log.Errorf("Error while accepting connection: %s", err.Error())
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+
+			log.Errorf("Error while accepting connection on %s/%s, retrying in %s: %s", address.Network(), address, delay, err.Error())
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+
+		if err != nil && !a.listeners.Drop(address, l) {
+			// the listener has been stopped
+			break
+		} else if err != nil {
+			log.Errorf("Error while accepting connection, listener stopped: %s/%s: %s", address.Network(), address, err.Error())
 			break
 		}
 
-		fmt.Println(color.YellowString("Accepting connection from %s => %s", rw.RemoteAddr().String(), rw.LocalAddr().String()))
+		if reason := a.filter.check(rw.RemoteAddr()); reason != "" {
+			a.filtered(address, rw, reason)
+			continue
+		}
 
-		c, err := a.newConn(rw)
-		if err != nil {
+		t, reason, wait := a.limiter.admit(address, rw.RemoteAddr())
+		if t == nil {
+			a.limited(address, rw, reason, wait)
 			continue
 		}
 
-		go c.serve()
+		a.forward(address, rw, t)
 	}
 
 	return nil
 }
 
-func localIP() string {
+// forward forwards the connection accepted by the listener on address to a
+// server, t is released when the session closes.
+func (a *Agent) forward(address net.Addr, rw net.Conn, t *ticket) {
+	r := a.route(address, rw.RemoteAddr())
+	if r == nil {
+		log.Warningf("No server available, rejecting connection from %s", rw.RemoteAddr().String())
+		t.release()
+		rw.Close()
+		return
+	}
+
+	fmt.Println(color.YellowString("Accepting connection from %s => %s", rw.RemoteAddr().String(), rw.LocalAddr().String()))
+
+	c, err := a.newConn(rw, r, a.limits(address), t)
+	if err != nil {
+		t.release()
+		return
+	}
+
+	a.session(c.serve)
+}
+
+// session runs fn in a goroutine, it counts as an open session until fn
+// returns.
+func (a *Agent) session(fn func()) {
+	a.sessions.Add(1)
+	atomic.AddInt32(&a.open, 1)
+
+	go func() {
+		defer a.sessions.Done()
+		defer atomic.AddInt32(&a.open, -1)
+
+		fn()
+	}()
+}
+
+// route returns the server new sessions from raddr, accepted by the
+// listener on address, will be forwarded to. Connected servers are
+// preferred over servers whose sessions are suspended, nil will be returned
+// if no server is available. Udp sessions are only forwarded to servers
+// supporting udp.
+func (a *Agent) route(address net.Addr, raddr net.Addr) *remote {
+	_, udp := address.(*net.UDPAddr)
+
+	available := func(r *remote) bool {
+		return !udp || r.supports(CapabilityUDP)
+	}
+
+	candidates := []*remote{}
+	for _, r := range a.remotes {
+		if r.connected() && available(r) {
+			candidates = append(candidates, r)
+		}
+	}
+
+	if len(candidates) == 0 {
+		for _, r := range a.remotes {
+			if r.suspending() && available(r) {
+				candidates = append(candidates, r)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if a.config.Distribution != DistributionSourceIP {
+		return candidates[0]
+	}
+
+	// rendezvous hashing, only the sessions of a server that becomes
+	// unavailable will move to another server
+	ip := hostIP(raddr)
+
+	var best *remote
+	var bestScore uint32
+
+	for _, r := range candidates {
+		h := fnv.New32a()
+		h.Write(ip)
+		h.Write([]byte(r.address))
+
+		if score := h.Sum32(); best == nil || score > bestScore {
+			best, bestScore = r, score
+		}
+	}
+
+	return best
+}
+
+// hostIP returns the ip address of address.
+func hostIP(address net.Addr) net.IP {
+	switch v := address.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	default:
+		return nil
+	}
+}
+
+// setActive marks the server as active while it is connected or its
+// sessions are suspended. The listeners are closed when no server is
+// active anymore.
+func (a *Agent) setActive(r *remote, active bool) {
+	a.lm.Lock()
+	defer a.lm.Unlock()
+
+	r.active = active
+	if active {
+		return
+	}
+
+	for _, o := range a.remotes {
+		if o.active {
+			return
+		}
+	}
+
+	a.listeners.CloseAll()
+}
+
+// Subscribe returns a channel receiving the session events.
+func (a *Agent) Subscribe() <-chan Event {
+	return a.conns.Subscribe()
+}
+
+func (a *Agent) logEvents(events <-chan Event) {
+	for e := range events {
+		switch e.Type {
+		case EventOpened:
+			log.Debugf("Session %d opened: %s => %s", e.ID, e.Raddr, e.Laddr)
+		case EventClosed:
+			fmt.Println(color.YellowString("Connection closed: %s => %s", e.Raddr.String(), e.Laddr.String()))
+		}
+	}
+}
+
+// Heartbeat returns the heartbeat statistics of the connections with the
+// servers, indexed by server address.
+func (a *Agent) Heartbeat() map[string]HeartbeatStats {
+	stats := map[string]HeartbeatStats{}
+	for _, r := range a.remotes {
+		stats[r.address] = r.heartbeat.Stats()
+	}
+
+	return stats
+}
+
+// States returns the state of the connections with the servers, indexed by
+// server address.
+func (a *Agent) States() map[string]State {
+	states := map[string]State{}
+	for _, r := range a.remotes {
+		states[r.address] = r.State()
+	}
+
+	return states
+}
+
+func listen(address net.Addr, limits Limits) (net.Listener, error) {
+	switch a := address.(type) {
+	case *net.TCPAddr:
+		return net.Listen(a.Network(), a.String())
+	case *net.UDPAddr:
+		return listenUDP(a, limits.IdleTimeout)
+	default:
+		return nil, fmt.Errorf("Unsupported address type: %s", address.Network())
+	}
+}
+
+// localIPs returns the ipv4 and ipv6 addresses of the host, without
+// loopback and link local addresses.
+func localIPs() []net.IP {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return ""
+		return nil
 	}
+
+	ips := []net.IP{}
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() == nil {
-				continue
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
 
-			return ipnet.IP.String()
+		if ip := ipnet.IP.To4(); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			ips = append(ips, ipnet.IP)
 		}
 	}
-	return ""
+
+	return ips
 }
 
-func (a *Agent) Run(ctx context.Context) {
+// Run connects to the servers and forwards the sessions until ctx is done,
+// then the agent shuts down gracefully. The error describes what couldn't
+// be completed within the drain timeout.
+func (a *Agent) Run(ctx context.Context) error {
 	log.Info("Honeytrap Agent started.")
 
-	go func() {
-		for {
-			a.in = make(chan encoding.BinaryMarshaler)
-
-			func() {
-				fmt.Println(color.YellowString("Connecting to Honeytrap... "))
-
-				// configure the Disco connection
-				clientConfig := libdisco.Config{
-					HandshakePattern: libdisco.Noise_NK,
-					RemoteKey:        a.RemoteKey,
-				}
-
-				conn, err := libdisco.Dial("tcp", a.Server, &clientConfig)
-				if err != nil {
-					log.Errorf("Error connecting to server: %s: %s", a.Server, err.Error())
-					return
-				}
-
-				cc := &agentConnection{conn}
-
-				defer cc.Close()
-
-				fmt.Println(color.YellowString("Connected to Honeytrap."))
-
-				defer func() {
-					fmt.Println(color.YellowString("Honeytrap disconnected."))
-				}()
-
-				cc.send(Handshake{})
-
-				o, err := cc.receive()
-				if err != nil {
-					log.Errorf("Invalid handshake response: %s", err.Error())
-					return
-				}
-
-				hr, ok := o.(*HandshakeResponse)
-				if !ok {
-					log.Errorf("Invalid handshake response: %s", err.Error())
-					return
-				}
-
-				listeners := []net.Listener{}
-				defer func() {
-					for _, l := range listeners {
-						l.Close()
-					}
-				}()
-
-				// we know what ports to listen to
-				for _, address := range hr.Addresses {
-					if _, ok := address.(*net.TCPAddr); ok {
-						l, err := net.Listen(address.Network(), address.String())
-						if err != nil {
-							fmt.Println(color.RedString("Error starting listener: %s", err.Error()))
-							continue
-						}
-
-						log.Infof("Listener started: %s", address)
-
-						listeners = append(listeners, l)
-
-						go a.serv(l)
-					} else if ua, ok := address.(*net.UDPAddr); ok {
-						_ = ua
-						log.Errorf("Not implemented yet")
-					}
-				}
-
-				go func() {
-					for {
-						select {
-						case <-time.After(time.Second * 5):
-							cc.send(Ping{})
-						case data, ok := <-a.in:
-							if !ok {
-								break
-							}
-
-							cc.send(data)
-						}
-					}
-				}()
-
-				for {
-					o, err := cc.receive()
-					if err == io.EOF {
-						return
-					} else if err != nil {
-						fmt.Println(err.Error())
-						return
-					}
-
-					switch v := o.(type) {
-					case *ReadWrite:
-						conn := a.conns.Get(v.Laddr, v.Raddr)
-						if conn == nil {
-							break
-						}
-
-						conn.out <- v.Payload
-					case *EOF:
-						conn := a.conns.Get(v.Laddr, v.Raddr)
-						if conn == nil {
-							break
-						}
-
-						fmt.Println(color.YellowString("Connection closed: %s => %s", v.Raddr.String(), v.Laddr.String()))
-
-						conn.Close()
-					}
-				}
-			}()
-
-			time.Sleep(time.Second * 2)
-		}
+	events := a.Subscribe()
 
-	}()
+	// the servers stay connected while shutting down
+	s := newSupervisor(context.Background())
+
+	s.Go(func(ctx context.Context) {
+		a.logEvents(events)
+	})
+
+	for _, r := range a.remotes {
+		s.Go(r.run)
+	}
+
+	s.Go(a.filterLoop)
+	s.Go(a.reportLoop)
 
 	<-ctx.Done()
+
+	err := a.shutdown()
+
+	// stops logEvents
+	a.conns.Unsubscribe(events)
+
+	// disconnects the servers, aborting the connections still dialing or
+	// handshaking
+	s.Stop()
+
+	return err
 }
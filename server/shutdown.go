@@ -0,0 +1,131 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// shutdown stops accepting new sessions, closes the open sessions and says
+// goodbye to the servers once the messages queued for them have been sent.
+// It gives up after the drain timeout, the error describes what hasn't been
+// completed.
+func (a *Agent) shutdown() error {
+	log.Infof("Shutting down, draining sessions for at most %s.", a.config.DrainTimeout)
+
+	start := time.Now()
+
+	atomic.StoreInt32(&a.stopping, 1)
+
+	a.listeners.CloseAll()
+	a.local.CloseAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.DrainTimeout)
+	defer cancel()
+
+	errs := []string{}
+
+	drained := make(chan struct{})
+
+	go func() {
+		defer close(drained)
+
+		for _, c := range a.conns.All() {
+			c.terminate(EOFReasonShutdown)
+		}
+
+		a.sessions.Wait()
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Sprintf("%d sessions didn't close in time", atomic.LoadInt32(&a.open)))
+	}
+
+	results := make(chan error, len(a.remotes))
+	for _, r := range a.remotes {
+		go func(r *remote) {
+			results <- r.goodbye(ctx)
+		}(r)
+	}
+
+	for range a.remotes {
+		err := <-results
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Shutdown incomplete: %s.", strings.Join(errs, ", "))
+	}
+
+	log.Infof("Shutdown completed in %s.", time.Since(start))
+	return nil
+}
+
+// goodbye tells the server the agent is going away, after the messages
+// queued for the server have been sent.
+func (r *remote) goodbye(ctx context.Context) error {
+	u := r.current()
+	if u == nil && r.suspending() {
+		return fmt.Errorf("server %s unreachable, its sessions have been closed without notice", r)
+	} else if u == nil {
+		return nil
+	}
+
+	f := make(flush)
+
+	go func() {
+		if r.supports(CapabilityControl) {
+			u.send(Control{
+				Command: ControlGoAway,
+				Value:   "shutdown",
+			})
+		}
+
+		u.send(f)
+	}()
+
+	select {
+	case <-f:
+		return nil
+	case <-u.supervisor.Done():
+		return fmt.Errorf("connection with %s lost while flushing", r)
+	case <-ctx.Done():
+		return fmt.Errorf("timeout flushing the messages for %s", r)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShutdownDuringHandshake checks that the drain timeout bounds the
+// shutdown, while a server accepted the connection but never completes the
+// handshake, and that the sessions that didn't close are reported.
+func TestShutdownDuringHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeytrap-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		// never answer the handshake
+		accepted <- c
+	}()
+
+	a, err := New(
+		WithServer(l.Addr().String()),
+		WithKey(strings.Repeat("00", 32)),
+		WithToken(filepath.Join(dir, "token")),
+		WithTransport(&TLSTransport{Config: &tls.Config{InsecureSkipVerify: true}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.config.DrainTimeout = 200 * time.Millisecond
+
+	// a session that doesn't close when terminated
+	release := make(chan struct{})
+	defer close(release)
+
+	a.session(func() {
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent didn't connect to the server.")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "1 sessions didn't close in time") {
+			t.Fatalf("Expected the session that didn't close to be reported, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run didn't return within 2 seconds after the drain timeout.")
+	}
+}
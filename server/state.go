@@ -0,0 +1,120 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// State is the state of the connection with a server.
+type State int
+
+const (
+	// StateConnecting is the state while dialing the server.
+	StateConnecting State = iota
+	// StateHandshaking is the state while negotiating the protocol.
+	StateHandshaking
+	// StateConnected is the state while sessions are forwarded to the
+	// server.
+	StateConnected
+	// StateBackingOff is the state while waiting to reconnect.
+	StateBackingOff
+	// StateStopped is the state after the server rejected the agent, the
+	// agent doesn't reconnect.
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateHandshaking:
+		return "handshaking"
+	case StateConnected:
+		return "connected"
+	case StateBackingOff:
+		return "backing-off"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// backoff calculates the delay before reconnecting, doubling the delay
+// after every failed attempt up to max. Half of the delay is random, so
+// agents don't reconnect in lockstep after a server returns.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+
+	m       sync.Mutex
+	attempt uint
+	rand    *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min:  min,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay before the next attempt.
+func (b *backoff) next() time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	d := b.min
+	for i := uint(0); i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+
+	if d > b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+
+	half := d / 2
+	return half + time.Duration(b.rand.Int63n(int64(d-half)+1))
+}
+
+// reset starts over with the minimum delay, after connecting successfully.
+func (b *backoff) reset() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.attempt = 0
+}
@@ -0,0 +1,83 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// supervisor runs the goroutines belonging to a context, like the
+// goroutines of a server connection. Stop cancels the context and waits
+// until all goroutines have returned, so none of them outlives its owner.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+func newSupervisor(parent context.Context) *supervisor {
+	ctx, cancel := context.WithCancel(parent)
+
+	return &supervisor{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Go runs fn in a new goroutine, fn should return when ctx is done.
+func (s *supervisor) Go(fn func(ctx context.Context)) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		fn(s.ctx)
+	}()
+}
+
+// Done returns a channel that is closed when the goroutines are asked to
+// stop.
+func (s *supervisor) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Cancel asks the goroutines to stop, without waiting for them.
+func (s *supervisor) Cancel() {
+	s.cancel()
+}
+
+// Stop asks the goroutines to stop, and waits until they have returned.
+func (s *supervisor) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
@@ -0,0 +1,446 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mimoo/disco/libdisco"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Transports, selecting how the connection with the server is established.
+const (
+	// TransportDisco uses the Disco protocol, authenticating the server
+	// using its remote key.
+	TransportDisco = "disco"
+	// TransportTLS uses tls, optionally with a client certificate and
+	// pinned server keys.
+	TransportTLS = "tls"
+	// TransportTCP uses plain tcp without any encryption or
+	// authentication, only meant for local testing.
+	TransportTCP = "tcp"
+)
+
+// Transport establishes the connection with a server, the protocol runs on
+// top of the returned connection. Dialing, including the handshake of the
+// transport, is aborted when ctx is done.
+type Transport interface {
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+// handshaker is a connection that authenticates the peer in a handshake.
+type handshaker interface {
+	net.Conn
+
+	Handshake() error
+}
+
+// handshake runs the handshake of conn within the deadline of ctx, it is
+// aborted when ctx is done. The connection is closed if the handshake
+// fails.
+func handshake(ctx context.Context, conn handshaker) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			// unblocks the handshake
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err := conn.Handshake()
+
+	close(done)
+	<-stopped
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// dial connects to address using tcp, it is aborted when ctx is done.
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	d := net.Dialer{}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// Disco handshake patterns supported by the agent.
+const (
+	// PatternNK authenticates the server using its known public key.
+	PatternNK = "NK"
+	// PatternXX exchanges the static keys of both sides, the server key
+	// is verified using its proof or compared with the remote key.
+	PatternXX = "XX"
+	// PatternIK sends the static key of the agent to a known server.
+	PatternIK = "IK"
+	// PatternKK is used when both sides know each others static key.
+	PatternKK = "KK"
+)
+
+// DiscoTransport connects using the Disco protocol. Pattern selects the
+// handshake, all patterns except NK authenticate the agent by KeyPair.
+type DiscoTransport struct {
+	Pattern string
+
+	// KeyPair is the static key pair of the agent.
+	KeyPair *libdisco.KeyPair
+
+	// RemoteKey is the public key of the server.
+	RemoteKey []byte
+
+	// Proof is the root signed proof of the agent public key.
+	Proof []byte
+
+	// RootKey verifies the proof of the server public key, when the
+	// server sends its key.
+	RootKey ed25519.PublicKey
+}
+
+// verifier returns the function verifying the static key received from
+// the server.
+func (t *DiscoTransport) verifier() func([]byte, []byte) bool {
+	if t.RootKey != nil {
+		return libdisco.CreatePublicKeyVerifier(t.RootKey)
+	}
+
+	return func(publicKey, _ []byte) bool {
+		return subtle.ConstantTimeCompare(publicKey, t.RemoteKey) == 1
+	}
+}
+
+func (t *DiscoTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	// configure the Disco connection
+	clientConfig := libdisco.Config{
+		HandshakePattern: libdisco.Noise_NK,
+		RemoteKey:        t.RemoteKey,
+	}
+
+	switch t.Pattern {
+	case PatternXX:
+		clientConfig.HandshakePattern = libdisco.Noise_XX
+		clientConfig.RemoteKey = nil
+		clientConfig.PublicKeyVerifier = t.verifier()
+	case PatternIK:
+		clientConfig.HandshakePattern = libdisco.Noise_IK
+	case PatternKK:
+		clientConfig.HandshakePattern = libdisco.Noise_KK
+	}
+
+	if t.Pattern != PatternNK && t.Pattern != "" {
+		clientConfig.KeyPair = t.KeyPair
+		clientConfig.StaticPublicKeyProof = append([]byte{}, t.Proof...)
+	}
+
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	dc := libdisco.Client(conn, &clientConfig)
+	if err := handshake(ctx, dc); err != nil {
+		return nil, err
+	}
+
+	return dc, nil
+}
+
+// TLSTransport connects using tls.
+type TLSTransport struct {
+	Config *tls.Config
+}
+
+func (t *TLSTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(conn, t.Config)
+	if err := handshake(ctx, tc); err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// TCPTransport connects using plain tcp.
+type TCPTransport struct {
+}
+
+func (t *TCPTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return dial(ctx, address)
+}
+
+// TLSConfig contains the tls settings.
+type TLSConfig struct {
+	// Enabled selects the tls transport, equal to transport: tls.
+	Enabled bool `yaml:"enabled"`
+
+	// CA is the path of the certificates used to verify the server, the
+	// system roots are used if empty. Relative paths are resolved against
+	// the Honeytrap home directory.
+	CA string `yaml:"ca"`
+
+	// Certificate and Key are the paths of the client certificate and
+	// its private key.
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
+
+	// ServerName overrides the name used to verify the server
+	// certificate.
+	ServerName string `yaml:"server-name"`
+
+	// Pins contains the hex encoded sha256 hashes of the public keys
+	// accepted from the server. Without CA, the server is authenticated
+	// by the pinned key of its leaf certificate only, with CA any key of
+	// the verified chain can be pinned.
+	Pins []string `yaml:"pins"`
+}
+
+// DiscoConfig contains the settings of the disco transport.
+type DiscoConfig struct {
+	// Pattern is the handshake pattern: NK, XX, IK or KK.
+	Pattern string `yaml:"pattern"`
+
+	// Key is the path of the static key pair of the agent, a new key pair
+	// will be generated if the file doesn't exist.
+	Key string `yaml:"key"`
+
+	// Proof is the hex encoded root signed proof of the agent public key,
+	// sent with the key in the XX and IK patterns.
+	Proof string `yaml:"proof"`
+
+	// RootKey is the hex encoded ed25519 root key, used to verify the key
+	// of the server in the XX pattern instead of the remote key.
+	RootKey string `yaml:"root-key"`
+}
+
+// static returns true if the pattern requires a static key pair.
+func (c *DiscoConfig) static() bool {
+	return c.Pattern != PatternNK
+}
+
+// requireRemoteKey returns true if the remote key of the servers should be
+// set, which is not needed if the server key is verified by the root key.
+func (c *DiscoConfig) requireRemoteKey() bool {
+	return c.Pattern != PatternXX || c.RootKey == ""
+}
+
+func (c *DiscoConfig) Validate() error {
+	switch c.Pattern {
+	case PatternNK, PatternXX, PatternIK, PatternKK:
+	default:
+		return fmt.Errorf("Invalid handshake pattern %q, expected NK, XX, IK or KK.", c.Pattern)
+	}
+
+	if c.static() && c.Key == "" {
+		return fmt.Errorf("No key set for handshake pattern %s.", c.Pattern)
+	}
+
+	if _, err := hex.DecodeString(c.Proof); err != nil {
+		return fmt.Errorf("Invalid proof: %s", err.Error())
+	}
+
+	if c.RootKey == "" {
+		return nil
+	}
+
+	if data, err := hex.DecodeString(c.RootKey); err != nil || len(data) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid root key, expected %d hex encoded bytes.", ed25519.PublicKeySize)
+	}
+
+	return nil
+}
+
+// newTLSConfig returns the tls configuration for connecting to host.
+func newTLSConfig(c TLSConfig, host string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+
+	if config.ServerName == "" {
+		name, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ServerName = name
+	}
+
+	if c.CA != "" {
+		data, err := ioutil.ReadFile(homePath(c.CA))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading ca: %s", err.Error())
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in ca %s.", c.CA)
+		}
+	}
+
+	if c.Certificate != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(homePath(c.Certificate), homePath(c.Key))
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err.Error())
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.Pins) == 0 {
+		return config, nil
+	}
+
+	pins := map[string]bool{}
+	for _, pin := range c.Pins {
+		pins[strings.ToLower(pin)] = true
+	}
+
+	pinned := func(cert *x509.Certificate) bool {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return pins[hex.EncodeToString(sum[:])]
+	}
+
+	// the certificate chain will only be verified if a ca has been
+	// configured, the pins are verified always
+	config.InsecureSkipVerify = c.CA == ""
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if c.CA != "" {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if pinned(cert) {
+						return nil
+					}
+				}
+			}
+
+			return errors.New("Server certificate chain doesn't match any pin.")
+		}
+
+		// without ca only the leaf certificate can be trusted, its key
+		// signs the handshake, any other certificate could be sent by
+		// anyone
+		if len(rawCerts) == 0 {
+			return errors.New("No server certificate received.")
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		if pinned(cert) {
+			return nil
+		}
+
+		return errors.New("Server certificate doesn't match any pin.")
+	}
+
+	return config, nil
+}
+
+// newTransport returns the transport for connecting to server s.
+func newTransport(c Config, s ServerConfig) (Transport, error) {
+	switch c.transport() {
+	case TransportTLS:
+		config, err := newTLSConfig(c.TLS, serverAddress(s.Host))
+		if err != nil {
+			return nil, err
+		}
+
+		return &TLSTransport{Config: config}, nil
+	case TransportTCP:
+		log.Warningf("Using insecure plain tcp transport for %s.", s.Host)
+
+		return &TCPTransport{}, nil
+	default:
+		t := &DiscoTransport{
+			Pattern: c.Disco.Pattern,
+		}
+
+		key, err := s.key()
+		if err != nil {
+			return nil, err
+		}
+
+		t.RemoteKey = key
+		t.Proof, _ = hex.DecodeString(c.Disco.Proof)
+
+		if c.Disco.RootKey != "" {
+			key, _ := hex.DecodeString(c.Disco.RootKey)
+			t.RootKey = ed25519.PublicKey(key)
+		}
+
+		if !c.Disco.static() {
+			return t, nil
+		}
+
+		kp, err := loadKeyPair(c.Disco.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading key pair: %s", err.Error())
+		}
+
+		t.KeyPair = kp
+		return t, nil
+	}
+}
@@ -0,0 +1,353 @@
+/*
+* Honeytrap Agent
+* Copyright (C) 2016-2017 DutchSec (https://dutchsec.com/)
+*
+* This program is free software; you can redistribute it and/or modify it under
+* the terms of the GNU Affero General Public License version 3 as published by the
+* Free Software Foundation.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT
+* ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+* FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+* details.
+*
+* You should have received a copy of the GNU Affero General Public License
+* version 3 along with this program in the file "LICENSE".  If not, see
+* <http://www.gnu.org/licenses/agpl-3.0.txt>.
+*
+* See https://honeytrap.io/ for more details. All requests should be sent to
+* licensing@honeytrap.io
+*
+* The interactive user interfaces in modified source and object code versions
+* of this program must display Appropriate Legal Notices, as required under
+* Section 5 of the GNU Affero General Public License version 3.
+*
+* In accordance with Section 7(b) of the GNU Affero General Public License version 3,
+* these Appropriate Legal Notices must retain the display of the "Powered by
+* Honeytrap" logo and retain the original copyright notice. If the display of the
+* logo is not reasonably feasible for technical reasons, the Appropriate Legal Notices
+* must display the words "Powered by Honeytrap" and retain the original copyright notice.
+ */
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// idleTimeoutError is returned by reads from a udp session that has been
+// expired by the listener.
+type idleTimeoutError struct {
+	timeoutError
+}
+
+// udpListener implements net.Listener on top of a udp socket. Every new
+// (laddr, raddr) combination will be returned by Accept as a pseudo
+// connection, which allows udp sessions to be served like tcp connections.
+type udpListener struct {
+	*net.UDPConn
+
+	// idleTimeout is the time after which a session without any traffic
+	// in either direction will be expired, zero disables expiry.
+	idleTimeout time.Duration
+
+	m     sync.Mutex
+	conns map[string]*udpConn
+
+	accept chan *udpConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func listenUDP(address *net.UDPAddr, idleTimeout time.Duration) (*udpListener, error) {
+	uc, err := net.ListenUDP(address.Network(), address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{
+		UDPConn:     uc,
+		idleTimeout: idleTimeout,
+		conns:       map[string]*udpConn{},
+		accept:      make(chan *udpConn),
+		closed:      make(chan struct{}),
+	}
+
+	go l.readLoop()
+
+	if idleTimeout > 0 {
+		go l.expireLoop()
+	}
+
+	return l, nil
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.UDPConn.LocalAddr()
+}
+
+func (l *udpListener) Close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		err = l.UDPConn.Close()
+
+		l.m.Lock()
+		conns := l.conns
+		l.conns = map[string]*udpConn{}
+		l.m.Unlock()
+
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+
+	return err
+}
+
+func (l *udpListener) readLoop() {
+	defer l.Close()
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, raddr, err := l.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				log.Errorf("Error reading from udp listener %s: %s", l.Addr(), err.Error())
+			}
+
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		c, isNew := l.get(raddr)
+		if isNew {
+			select {
+			case l.accept <- c:
+			case <-l.closed:
+				return
+			}
+		}
+
+		select {
+		case c.in <- data:
+			c.touch()
+		default:
+			log.Debugf("Dropping udp datagram from %s => %s, queue full", raddr, l.Addr())
+		}
+	}
+}
+
+// get returns the session for raddr, creating it if it doesn't exist yet.
+func (l *udpListener) get(raddr *net.UDPAddr) (*udpConn, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if c, ok := l.conns[raddr.String()]; ok {
+		return c, false
+	}
+
+	c := &udpConn{
+		l:      l,
+		raddr:  raddr,
+		in:     make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+
+	c.touch()
+
+	l.conns[raddr.String()] = c
+	return c, true
+}
+
+func (l *udpListener) remove(c *udpConn) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if v, ok := l.conns[c.raddr.String()]; ok && v == c {
+		delete(l.conns, c.raddr.String())
+	}
+}
+
+func (l *udpListener) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.closed:
+			return
+		}
+
+		expired := []*udpConn{}
+
+		l.m.Lock()
+		for _, c := range l.conns {
+			if c.idle() > l.idleTimeout {
+				expired = append(expired, c)
+			}
+		}
+		l.m.Unlock()
+
+		for _, c := range expired {
+			log.Debugf("Udp session expired: %s => %s", c.RemoteAddr(), c.LocalAddr())
+			c.expire()
+		}
+	}
+}
+
+// udpConn is the pseudo connection for a single udp session.
+type udpConn struct {
+	// lastActivity contains the unix time in nanoseconds of the last
+	// datagram sent or received, it is accessed atomically and kept first
+	// for alignment.
+	lastActivity int64
+
+	l     *udpListener
+	raddr *net.UDPAddr
+
+	in chan []byte
+
+	m             sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	expired       bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *udpConn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *udpConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	c.m.Lock()
+	deadline := c.readDeadline
+	c.m.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-c.in:
+		return copy(b, data), nil
+	case <-c.closed:
+		c.m.Lock()
+		defer c.m.Unlock()
+
+		if c.expired {
+			return 0, idleTimeoutError{}
+		}
+
+		return 0, io.EOF
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.EOF
+	default:
+	}
+
+	c.m.Lock()
+	deadline := c.writeDeadline
+	c.m.Unlock()
+
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, timeoutError{}
+	}
+
+	c.touch()
+	return c.l.WriteToUDP(b, c.raddr)
+}
+
+// expire closes the session, pending reads will return an idle timeout error.
+func (c *udpConn) expire() {
+	c.m.Lock()
+	c.expired = true
+	c.m.Unlock()
+
+	c.Close()
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.l.remove(c)
+	})
+
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.l.Addr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.readDeadline = t
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}